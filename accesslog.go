@@ -0,0 +1,89 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Writes one line for each rewritten request, either in the Common Log Format
+// extended with the platform ("common") or as JSON objects ("json")
+type accessLog struct {
+	mu     sync.Mutex
+	out    io.WriteCloser
+	format string
+}
+
+func openAccessLog(path string, format string) (*accessLog, error) {
+	if format != "common" && format != "json" {
+		return nil, fmt.Errorf("invalid access log format '%s'", format)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open access log: %v", err)
+	}
+	return &accessLog{out: file, format: format}, nil
+}
+
+// Record a rewritten request; the response isn't tracked, so its status and
+// size are left out
+func (a *accessLog) record(peer string, requestLine []byte, platform string) {
+	if a == nil {
+		return
+	}
+	requestLine = bytes.TrimRight(requestLine, "\r\n")
+	now := time.Now()
+
+	var line []byte
+	if a.format == "json" {
+		method, target := requestLine, []byte(nil)
+		if start, end, err := parseRequestLine(requestLine); err == nil {
+			method, target = bytes.TrimRight(requestLine[:start], " \t"), requestLine[start:end]
+		}
+		line, _ = json.Marshal(struct {
+			Time     string `json:"time"`
+			Peer     string `json:"peer"`
+			Method   string `json:"method"`
+			Path     string `json:"path"`
+			Platform string `json:"platform"`
+		}{now.Format(time.RFC3339Nano), peer, string(method), string(target), platform})
+	} else {
+		line = []byte(fmt.Sprintf("%s - - [%s] %q - - %q",
+			peer, now.Format("02/Jan/2006:15:04:05 -0700"), requestLine, platform))
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(line); err != nil {
+		log.Error("unable to write access log:", err)
+	}
+}
+
+func (a *accessLog) close() {
+	if a == nil {
+		return
+	}
+	if err := a.out.Close(); err != nil {
+		log.Error("unable to close access log:", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	pull := "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	// Other requests aren't logged
+	ping := "GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n"
+	for _, format := range []string{"common", "json"} {
+		path := filepath.Join(t.TempDir(), "access.log")
+		accessLog, err := openAccessLog(path, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := testOptions(&fakeDaemon{})
+		opts.accessLog = accessLog
+		proxyRequests(t, opts, pull, ping)
+		accessLog.close()
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(lines) != 1 {
+			t.Fatalf("%s: got access log %q, expected one line", format, data)
+		}
+		if format == "common" {
+			expected := regexp.MustCompile(`^pipe - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] ` +
+				`"POST /v1.41/images/create\?fromImage=alpine&platform=linux%2Farm64 HTTP/1.1" - - "linux/arm64"$`)
+			if !expected.MatchString(lines[0]) {
+				t.Errorf("got access log line %q", lines[0])
+			}
+			continue
+		}
+
+		var entry map[string]string
+		if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+			t.Fatalf("access log line %q isn't JSON: %v", lines[0], err)
+		}
+		if logged, err := time.Parse(time.RFC3339Nano, entry["time"]); err != nil || time.Since(logged) > time.Minute {
+			t.Errorf("got time %q", entry["time"])
+		}
+		delete(entry, "time")
+		expected := map[string]string{
+			"peer":     "pipe",
+			"method":   "POST",
+			"path":     "/v1.41/images/create?fromImage=alpine&platform=linux%2Farm64",
+			"platform": "linux/arm64",
+		}
+		for key, value := range expected {
+			if entry[key] != value {
+				t.Errorf("%s is %q, expected %q", key, entry[key], value)
+			}
+		}
+		if len(entry) != len(expected) {
+			t.Errorf("got access log entry %v", entry)
+		}
+	}
+
+	if _, err := openAccessLog(filepath.Join(t.TempDir(), "access.log"), "combined"); err == nil {
+		t.Error("an unknown access log format was accepted")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Docker API version, e.g. 1.38
+type apiVersion struct {
+	major int
+	minor int
+}
+
+var apiVersionPattern = regexp.MustCompile(`^v?([0-9]+)\.([0-9]+)$`)
+
+// Parse an API version such as "1.38" or "v1.38"
+func parseAPIVersion(version string) (apiVersion, error) {
+	match := apiVersionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return apiVersion{}, fmt.Errorf("invalid API version '%s', expected e.g. 1.38", version)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	return apiVersion{major, minor}, nil
+}
+
+func (v apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+func (v apiVersion) before(other apiVersion) bool {
+	return v.major < other.major || (v.major == other.major && v.minor < other.minor)
+}
+
+// Endpoints by the name used in their -rewrite-* flag
+var endpointsByFlagName = map[string]*endpoint{
+	"images-create":     imagesCreate,
+	"build":             build,
+	"containers-create": containersCreate,
+	"image-inspect":     imageInspect,
+	"push":              imagePush,
+}
+
+// Flag collecting ENDPOINT=VERSION pairs: the oldest API version each endpoint
+// is rewritten for
+type minAPIVersionsFlag map[*endpoint]apiVersion
+
+func (f *minAPIVersionsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var versions []string
+	for name, ep := range endpointsByFlagName {
+		if version, ok := (*f)[ep]; ok {
+			versions = append(versions, name+"="+version.String())
+		}
+	}
+	sort.Strings(versions)
+	return strings.Join(versions, ",")
+}
+
+func (f *minAPIVersionsFlag) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i <= 0 {
+		return fmt.Errorf("'%s' is not in the ENDPOINT=VERSION format", value)
+	}
+	ep, ok := endpointsByFlagName[value[:i]]
+	if !ok {
+		var names []string
+		for name := range endpointsByFlagName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown endpoint '%s', expected one of %s", value[:i], strings.Join(names, ", "))
+	}
+	version, err := parseAPIVersion(value[i+1:])
+	if err != nil {
+		return err
+	}
+	if *f == nil {
+		*f = make(minAPIVersionsFlag)
+	}
+	(*f)[ep] = version
+	return nil
+}
+
+func (f *minAPIVersionsFlag) Get() interface{} {
+	return f.String()
+}
+
+var requestAPIVersion = regexp.MustCompile(`^/(v[0-9]+\.[0-9]+)/`)
+
+// Check whether a request line for the endpoint uses an API version older than
+// the one it's rewritten from. Requests without a version prefix use the
+// latest version the daemon supports, so they are never too old.
+func (f minAPIVersionsFlag) tooOld(ep *endpoint, requestLine []byte) (version apiVersion, minimum apiVersion, old bool) {
+	minimum, ok := f[ep]
+	if !ok {
+		return
+	}
+	start, end, err := parseRequestLine(requestLine)
+	if err != nil {
+		return
+	}
+	match := requestAPIVersion.FindSubmatch(requestLine[start:end])
+	if match == nil {
+		return
+	}
+	if version, err = parseAPIVersion(string(match[1])); err != nil {
+		return
+	}
+	return version, minimum, version.before(minimum)
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestParseAPIVersion(t *testing.T) {
+	for version, expected := range map[string]apiVersion{"1.38": {1, 38}, "v1.41": {1, 41}, "2.0": {2, 0}} {
+		if parsed, err := parseAPIVersion(version); err != nil || parsed != expected {
+			t.Errorf("%s: got %v and error %v, expected %v", version, parsed, err, expected)
+		}
+	}
+	for _, version := range []string{"", "1", "1.", "v", "1.38.1", "a.b"} {
+		if parsed, err := parseAPIVersion(version); err == nil {
+			t.Errorf("'%s' was parsed as %v", version, parsed)
+		}
+	}
+}
+
+func TestMinAPIVersionsFlag(t *testing.T) {
+	var versions minAPIVersionsFlag
+	for _, value := range []string{"build=1.38", "images-create=v1.32"} {
+		if err := versions.Set(value); err != nil {
+			t.Fatalf("%s: %v", value, err)
+		}
+	}
+	if s := versions.String(); s != "build=1.38,images-create=1.32" {
+		t.Errorf("got %s", s)
+	}
+	for _, value := range []string{"build", "=1.38", "pull=1.38", "build=latest"} {
+		if err := versions.Set(value); err == nil {
+			t.Errorf("'%s' was accepted", value)
+		}
+	}
+
+	tests := []struct {
+		ep      *endpoint
+		line    string
+		version apiVersion
+		old     bool
+	}{
+		{build, "POST /v1.37/build HTTP/1.1\r", apiVersion{1, 37}, true},
+		{build, "POST /v1.38/build HTTP/1.1\r", apiVersion{1, 38}, false},
+		{build, "POST /v1.41/build HTTP/1.1\r", apiVersion{1, 41}, false},
+		{build, "POST /build HTTP/1.1\r", apiVersion{}, false},
+		{imagesCreate, "POST /v1.31/images/create?fromImage=alpine HTTP/1.1\r", apiVersion{1, 31}, true},
+		{containersCreate, "POST /v1.12/containers/create HTTP/1.1\r", apiVersion{}, false},
+		{build, "POST /v1.37/build", apiVersion{}, false},
+	}
+	for _, test := range tests {
+		version, _, old := versions.tooOld(test.ep, []byte(test.line))
+		if version != test.version || old != test.old {
+			t.Errorf("%q: got version %v and old %t, expected %v and %t", test.line, version, old, test.version, test.old)
+		}
+	}
+}
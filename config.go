@@ -0,0 +1,102 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"net/url"
+	"time"
+)
+
+// Print the effective configuration as JSON: every option, defaults included,
+// along with the positional arguments. Options are shown as resolved from the
+// command line, the environment and the rules file, e.g. with the platform
+// taken from $TARGETPLATFORM and the HTTP proxy from $HTTP_PROXY.
+func printConfig(w io.Writer, opts *options, level logging.Level, platformSource string) error {
+	config := map[string]interface{}{}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.(flag.Getter).Get()
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case string:
+			value = redactURL(v)
+		}
+		config[f.Name] = value
+	})
+
+	config["docker-socket"] = opts.dockerNetwork + "://" + opts.dockerSock
+	switch {
+	case opts.listenMode == "stdio":
+		config["proxied-socket"] = "stdio"
+	case opts.listenFd >= 0:
+		config["proxied-socket"] = fmt.Sprintf("fd://%d", opts.listenFd)
+	default:
+		config["proxied-socket"] = opts.proxyNetwork + "://" + opts.proxySock
+	}
+	config["platform"] = opts.platform
+	config["platform-source"] = platformSource
+	config["log-level"] = level.String()
+	config["upstream-proxy"] = ""
+	if opts.upstreamProxy != nil {
+		config["upstream-proxy"] = redactURL(opts.upstreamProxy.String())
+	}
+
+	// Options normalized or parsed into lists
+	config["secondary-platform"] = opts.secondaryPlatform
+	config["platform-preference"] = nonNil(opts.platformPreference)
+	config["default-registry"] = opts.defaultRegistry
+	config["rewrite-methods"] = nonNil(opts.extraMethods)
+	config["client-exe"] = nonNil(opts.clientExes)
+	endpoints := []string{}
+	for _, ep := range opts.endpoints {
+		endpoints = append(endpoints, ep.name)
+	}
+	config["endpoints"] = endpoints
+	rules := []string{}
+	for _, r := range opts.rules {
+		rules = append(rules, r.text)
+	}
+	config["rules-loaded"] = rules
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(config)
+}
+
+// Get an empty list rather than nil, which would be encoded as null
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// Hide the password of URLs carrying credentials
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	return u.String()
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// Serve an HTTP proxy supporting nothing but CONNECT, which tunnels every
+// connection to target whatever the requested address. The CONNECT requests
+// received are sent to the returned channel.
+func connectProxy(t *testing.T, target string) (string, chan *http.Request) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	connects := make(chan *http.Request, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				connects <- req
+				if req.Method != "CONNECT" {
+					_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(upstream, reader) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String(), connects
+}
+
+func TestUpstreamThroughHTTPProxy(t *testing.T) {
+	platforms := make(chan string, 16)
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		platforms <- r.URL.Query().Get("platform")
+	}))
+	defer daemon.Close()
+	proxyAddress, connects := connectProxy(t, daemon.Listener.Addr().String())
+	proxyURL := "http://user:secret@" + proxyAddress
+
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		env      []string
+		tunneled bool
+	}{
+		{"HTTP_PROXY", []string{"HTTP_PROXY=" + proxyURL}, true},
+		{"HTTPS_PROXY", []string{"HTTPS_PROXY=" + proxyURL}, true},
+		{"NO_PROXY", []string{"HTTP_PROXY=" + proxyURL, "NO_PROXY=.example"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxySock := filepath.Join(dir, test.name+".sock")
+			// The daemon can only be reached through the tunnel
+			_, log := startProxy(t, test.env, "-no-banner", "tcp://docker.example:2375", proxySock, "linux/arm64")
+			log.waitFor(t, "listening on")
+			status := requestUnix(t, proxySock, "POST", "/v1.41/images/create?fromImage=alpine")
+
+			if !test.tunneled {
+				if status == http.StatusOK {
+					t.Error("reached the daemon without going through the HTTP proxy")
+				}
+				select {
+				case req := <-connects:
+					t.Errorf("the HTTP proxy got %s %s despite NO_PROXY", req.Method, req.RequestURI)
+				default:
+				}
+				return
+			}
+			if status != http.StatusOK {
+				t.Fatalf("got status %d", status)
+			}
+			req := <-connects
+			credentials := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+			if req.Method != "CONNECT" || req.RequestURI != "docker.example:2375" || req.Header.Get("Proxy-Authorization") != credentials {
+				t.Errorf("the HTTP proxy got %s %s with credentials %q", req.Method, req.RequestURI, req.Header.Get("Proxy-Authorization"))
+			}
+			if platform := <-platforms; platform != "linux/arm64" {
+				t.Errorf("the daemon got platform %q", platform)
+			}
+		})
+	}
+}
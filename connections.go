@@ -0,0 +1,229 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Check whether a read or write was interrupted by a signal before completing,
+// in which case it can just be retried
+func isInterrupted(err error) bool {
+	return err != nil && errors.Is(err, syscall.EINTR)
+}
+
+// Check whether a connection was used after being closed, e.g. by the other
+// direction of the proxy once it saw one of the ends hang up
+func isClosed(err error) bool {
+	return err != nil && (errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe))
+}
+
+// Check whether a read or write gave up because of a deadline. Files such as
+// the standard input report that with an *os.PathError, which is not a
+// net.Error.
+func isTimeout(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return err != nil && errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// A client connection being proxied
+type connInfo struct {
+	id    uint64
+	peer  string
+	start time.Time
+	conn  net.Conn
+	// Shared by both directions of the proxy and the drain timeout
+	closer *connCloser
+	// Bytes forwarded in both directions, updated atomically
+	bytes int64
+	// When data was last forwarded in either direction, in Unix nanoseconds, updated atomically
+	lastActive int64
+}
+
+func (c *connInfo) addBytes(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&c.bytes, int64(n))
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// How long it's been since data was last forwarded
+func (c *connInfo) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+// Closes a connection exactly once, even when several goroutines give up on
+// it at the same time
+type connCloser struct {
+	conn net.Conn
+	once sync.Once
+}
+
+// Close the connection unless that already happened, reporting whether this
+// call closed it
+func (c *connCloser) close() (closed bool, err error) {
+	c.once.Do(func() {
+		closed = true
+		err = c.conn.Close()
+	})
+	return closed, err
+}
+
+func (c *connInfo) String() string {
+	return fmt.Sprintf("id=%d peer=%s age=%s idle=%s bytes=%d",
+		c.id, c.peer, time.Since(c.start).Truncate(time.Millisecond), c.idle().Truncate(time.Millisecond),
+		atomic.LoadInt64(&c.bytes))
+}
+
+// Keeps track of the client connections currently being proxied
+type connRegistry struct {
+	mu     sync.Mutex
+	lastId uint64
+	conns  map[uint64]*connInfo
+}
+
+var activeConns = connRegistry{conns: make(map[uint64]*connInfo)}
+
+func (r *connRegistry) add(conn net.Conn) *connInfo {
+	peer := conn.RemoteAddr().String()
+	if peer == "" || peer == "@" {
+		// Clients of Unix sockets are normally unnamed
+		peer = "unnamed"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastId++
+	now := time.Now()
+	info := &connInfo{id: r.lastId, peer: peer, start: now, conn: conn, closer: &connCloser{conn: conn}, lastActive: now.UnixNano()}
+	r.conns[info.id] = info
+	return info
+}
+
+func (r *connRegistry) remove(info *connInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, info.id)
+}
+
+// Copy of the active connections, oldest first
+func (r *connRegistry) snapshot() []connInfo {
+	r.mu.Lock()
+	snapshot := make([]connInfo, 0, len(r.conns))
+	for _, info := range r.conns {
+		snapshot = append(snapshot, connInfo{
+			id:         info.id,
+			peer:       info.peer,
+			start:      info.start,
+			conn:       info.conn,
+			closer:     info.closer,
+			bytes:      atomic.LoadInt64(&info.bytes),
+			lastActive: atomic.LoadInt64(&info.lastActive),
+		})
+	}
+	r.mu.Unlock()
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].id < snapshot[j].id
+	})
+	return snapshot
+}
+
+func (r *connRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// Close all the client connections, returning how many there were
+func (r *connRegistry) closeAll() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, info := range r.conns {
+		_, _ = info.closer.close()
+	}
+	return len(r.conns)
+}
+
+// How often the number of connections left is logged while draining
+var drainReportInterval = 5 * time.Second
+
+// Wait up to timeout for the active connections to finish, logging how many
+// are left, then close the remaining ones
+func (r *connRegistry) drain(timeout time.Duration) {
+	if timeout <= 0 || r.count() == 0 {
+		return
+	}
+	log.Noticef("waiting up to %s for %d connections to finish", timeout, r.count())
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	report := time.NewTicker(drainReportInterval)
+	defer report.Stop()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-poll.C:
+			if r.count() == 0 {
+				log.Notice("all connections finished")
+				return
+			}
+		case <-report.C:
+			log.Noticef("%d connections still active", r.count())
+		case <-deadline.C:
+			log.Warningf("drain timeout expired, closing %d connections", r.closeAll())
+			return
+		}
+	}
+}
+
+// Close the connections that haven't forwarded anything for longer than
+// timeout, checking every interval until stop is closed
+func (r *connRegistry) reapIdle(timeout time.Duration, interval time.Duration, stop <-chan struct{}) {
+	sweep := time.NewTicker(interval)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sweep.C:
+			r.mu.Lock()
+			for _, info := range r.conns {
+				if idle := info.idle(); idle > timeout {
+					if closed, _ := info.closer.close(); closed {
+						log.Infof("closed connection %d from %s, idle for %s", info.id, info.peer, idle.Truncate(time.Second))
+					}
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
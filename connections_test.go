@@ -0,0 +1,188 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+func TestConnRegistrySnapshot(t *testing.T) {
+	registry := connRegistry{conns: make(map[uint64]*connInfo)}
+	first, firstPeer := net.Pipe()
+	defer first.Close()
+	defer firstPeer.Close()
+	second, secondPeer := net.Pipe()
+	defer second.Close()
+	defer secondPeer.Close()
+
+	firstInfo := registry.add(first)
+	secondInfo := registry.add(second)
+	secondInfo.addBytes(42)
+	snapshot := registry.snapshot()
+	if len(snapshot) != 2 || snapshot[0].id != firstInfo.id || snapshot[1].id != secondInfo.id {
+		t.Fatalf("got snapshot %v, expected both connections, oldest first", snapshot)
+	}
+	if snapshot[0].bytes != 0 || snapshot[1].bytes != 42 || snapshot[0].peer != "pipe" {
+		t.Errorf("got snapshot %v", snapshot)
+	}
+
+	// The snapshot is a copy
+	secondInfo.addBytes(1)
+	if snapshot[1].bytes != 42 {
+		t.Errorf("snapshot changed to %d bytes", snapshot[1].bytes)
+	}
+	registry.remove(firstInfo)
+	if snapshot := registry.snapshot(); len(snapshot) != 1 || snapshot[0].id != secondInfo.id {
+		t.Errorf("got snapshot %v after removing the first connection", snapshot)
+	}
+}
+
+func TestHandleConnectionRegistersConnection(t *testing.T) {
+	proxyConnection(t, testOptions(&fakeDaemon{}), func(client net.Conn, reader *bufio.Reader) {
+		if _, err := client.Write([]byte("GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n")); err != nil {
+			t.Fatal("unable to send request:", err)
+		}
+		if status := readResponse(t, reader); status != http.StatusOK {
+			t.Fatalf("got status %d", status)
+		}
+		if snapshot := activeConns.snapshot(); len(snapshot) != 1 || snapshot[0].bytes == 0 {
+			t.Errorf("got active connections %v while proxying", snapshot)
+		}
+	})
+	if count := activeConns.count(); count != 0 {
+		t.Errorf("%d connections left active once closed", count)
+	}
+}
+
+func TestConnRegistryDrain(t *testing.T) {
+	defer func(interval time.Duration) { drainReportInterval = interval }(drainReportInterval)
+	drainReportInterval = 50 * time.Millisecond
+
+	// A connection lingering past the timeout is closed
+	logs := recordLogs(t, logging.NOTICE)
+	registry := connRegistry{conns: make(map[uint64]*connInfo)}
+	lingering, peer := net.Pipe()
+	defer peer.Close()
+	registry.add(lingering)
+	registry.drain(300 * time.Millisecond)
+	if !logs.contains(logging.NOTICE, "1 connections still active") {
+		t.Errorf("the remaining connections weren't reported; logged %q", logs.messages(logging.NOTICE, ""))
+	}
+	if !logs.contains(logging.WARNING, "drain timeout expired, closing 1 connections") {
+		t.Errorf("the forced close wasn't logged; logged %q", logs.messages(logging.NOTICE, ""))
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v reading from the lingering connection, expected it to be closed", err)
+	}
+
+	// A connection finishing in time
+	logs = recordLogs(t, logging.NOTICE)
+	registry = connRegistry{conns: make(map[uint64]*connInfo)}
+	finishing, peer := net.Pipe()
+	defer finishing.Close()
+	defer peer.Close()
+	info := registry.add(finishing)
+	time.AfterFunc(100*time.Millisecond, func() { registry.remove(info) })
+	registry.drain(5 * time.Second)
+	if !logs.contains(logging.NOTICE, "all connections finished") || logs.contains(logging.WARNING, "drain timeout expired") {
+		t.Errorf("logged %q", logs.messages(logging.NOTICE, ""))
+	}
+}
+
+func TestConnCloserClosesOnce(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	closer := &connCloser{conn: conn}
+	var wg sync.WaitGroup
+	var closed int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if didClose, err := closer.close(); err != nil {
+				t.Error("unable to close:", err)
+			} else if didClose {
+				atomic.AddInt32(&closed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if closed != 1 {
+		t.Errorf("the connection was closed %d times", closed)
+	}
+}
+
+func TestHandleConnectionBothSidesHangUp(t *testing.T) {
+	logs := recordLogs(t, logging.ERROR)
+	daemon := &fakeDaemon{reply: func(int, *http.Request) (string, bool) {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", true
+	}}
+	for i := 0; i < 20; i++ {
+		proxyConnection(t, testOptions(daemon), func(client net.Conn, reader *bufio.Reader) {
+			if _, err := client.Write([]byte("GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n")); err != nil {
+				t.Fatal("unable to send request:", err)
+			}
+			// Both ends go away at about the same time
+			_ = client.Close()
+		})
+	}
+	if errors := logs.messages(logging.ERROR, ""); len(errors) > 0 {
+		t.Errorf("errors were logged: %q", errors)
+	}
+}
+
+func TestConnRegistryReapIdle(t *testing.T) {
+	registry := connRegistry{conns: make(map[uint64]*connInfo)}
+	var idlePeers []net.Conn
+	for i := 0; i < 50; i++ {
+		conn, peer := net.Pipe()
+		defer peer.Close()
+		registry.add(conn)
+		idlePeers = append(idlePeers, peer)
+	}
+	busy, busyPeer := net.Pipe()
+	defer busy.Close()
+	defer busyPeer.Close()
+	busyInfo := registry.add(busy)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go registry.reapIdle(200*time.Millisecond, 20*time.Millisecond, stop)
+	for deadline := time.Now().Add(400 * time.Millisecond); time.Now().Before(deadline); {
+		busyInfo.addBytes(1)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, peer := range idlePeers {
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("got %v reading from idle connection %d, expected it to be closed", err, i)
+		}
+	}
+	_ = busyPeer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := busyPeer.Read(make([]byte, 1)); err == io.EOF {
+		t.Error("the busy connection was closed")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+)
+
+// A Docker API endpoint whose requests can get the platform injected
+type endpoint struct {
+	// Human readable name, used for logging
+	name   string
+	method string
+	// Matched against the request path, including the optional API version prefix
+	path *regexp.Regexp
+	// Whether the endpoint expects the platform as a JSON-encoded OCI platform
+	// object rather than as an "os/arch[/variant]" string
+	jsonPlatform bool
+}
+
+func apiPath(path string) *regexp.Regexp {
+	return regexp.MustCompile(`^(/v[0-9.]+)?` + path + `$`)
+}
+
+var (
+	imagesCreate = &endpoint{
+		name:   "docker image create/pull",
+		method: "POST",
+		path:   apiPath(`/images/create`),
+	}
+	imageInspect = &endpoint{
+		name:   "docker image inspect",
+		method: "GET",
+		path:   apiPath(`/images/.+/json`),
+		// Since API 1.49
+		jsonPlatform: true,
+	}
+	build = &endpoint{
+		name:   "docker build",
+		method: "POST",
+		path:   apiPath(`/build`),
+	}
+	containersCreate = &endpoint{
+		name:   "docker container create",
+		method: "POST",
+		path:   apiPath(`/containers/create`),
+	}
+	imagePush = &endpoint{
+		name:   "docker image push",
+		method: "POST",
+		path:   apiPath(`/images/.+/push`),
+		// Since API 1.46
+		jsonPlatform: true,
+	}
+)
+
+// Format the platform the way the endpoint expects it
+func (e *endpoint) platformValue(platform string) (string, error) {
+	if !e.jsonPlatform {
+		return platform, nil
+	}
+	os, arch, variant := splitPlatform(platform)
+	value, err := json.Marshal(struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant,omitempty"`
+	}{os, arch, variant})
+	return string(value), err
+}
+
+// Check whether a (possibly incomplete) request line targets the endpoint with
+// the given method
+func (e *endpoint) matches(requestLine []byte, method string) bool {
+	if !bytes.HasPrefix(requestLine, []byte(method)) {
+		return false
+	}
+	target := requestLine[len(method):]
+	if len(target) == 0 || !isBlank(target[0]) {
+		return false
+	}
+	target = bytes.TrimLeft(target, " \t")
+	if i := bytes.IndexAny(target, " \t?\r\n"); i >= 0 {
+		target = target[:i]
+	}
+	return e.path.Match(target)
+}
+
+// Find the endpoint targeted by the request line at the beginning of buffer,
+// either with its own method or with one of extraMethods, or nil if there's
+// none. Only the beginning of requests must be passed, so that e.g. a build
+// context or label mentioning an endpoint isn't mistaken for a request.
+func requestEndpoint(buffer []byte, endpoints []*endpoint, extraMethods []string) *endpoint {
+	for _, e := range endpoints {
+		if e.matches(buffer, e.method) {
+			return e
+		}
+		for _, method := range extraMethods {
+			if e.matches(buffer, method) {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// Check whether an incomplete line may be the beginning of a request line for
+// one of the endpoints, in which case it's worth waiting for the rest of it
+func mayStartRequest(line []byte, endpoints []*endpoint, extraMethods []string) bool {
+	for _, e := range endpoints {
+		methods := append([]string{e.method}, extraMethods...)
+		for _, method := range methods {
+			if len(line) <= len(method) && bytes.HasPrefix([]byte(method), line) {
+				// Not even the method has been received yet
+				return true
+			}
+			if len(line) > len(method) && bytes.HasPrefix(line, []byte(method)) && isBlank(line[len(method)]) {
+				return true
+			}
+		}
+	}
+	return false
+}
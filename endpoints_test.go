@@ -0,0 +1,130 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRequestEndpoint(t *testing.T) {
+	endpoints := []*endpoint{imagesCreate, build, containersCreate}
+	tests := []struct {
+		request      string
+		extraMethods []string
+		endpoint     *endpoint
+	}{
+		{request: "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\n", endpoint: imagesCreate},
+		{request: "POST /images/create HTTP/1.1\r\n", endpoint: imagesCreate},
+		{request: "POST \t/v1.41/build?t=app HTTP/1.1\r\n", endpoint: build},
+		{request: "POST /v1.44/containers/create?name=app HTTP/1.1\r\n", endpoint: containersCreate},
+		// Request lines that haven't completely been received yet
+		{request: "POST /v1.41/images/create", endpoint: imagesCreate},
+		{request: "POST /v1.41/images/cre"},
+		{request: "POST /v1.41/images/create/x HTTP/1.1\r\n"},
+		{request: "GET /v1.41/images/create HTTP/1.1\r\n"},
+		{request: "PUT /v1.41/images/create HTTP/1.1\r\n", extraMethods: []string{"PUT"}, endpoint: imagesCreate},
+		{request: "POSTER /v1.41/images/create HTTP/1.1\r\n"},
+		// Only the beginning of the buffer is looked at
+		{request: "\r\nPOST /v1.41/images/create HTTP/1.1\r\n"},
+		{request: "GET /info HTTP/1.1\r\n\r\nPOST /v1.41/images/create HTTP/1.1\r\n"},
+	}
+
+	for _, test := range tests {
+		if ep := requestEndpoint([]byte(test.request), endpoints, test.extraMethods); ep != test.endpoint {
+			t.Errorf("%q: got %v, expected %v", test.request, ep, test.endpoint)
+		}
+	}
+}
+
+func TestMayStartRequest(t *testing.T) {
+	endpoints := []*endpoint{imagesCreate}
+	tests := []struct {
+		line     string
+		mayStart bool
+	}{
+		{"POST /v1.41/images/cr", true},
+		{"POST ", true},
+		{"POST", true},
+		{"P", true},
+		{"PUT", false},
+		{"GET /v1.41/images/create", false},
+		{"POSTER /images/create", false},
+	}
+
+	for _, test := range tests {
+		if mayStart := mayStartRequest([]byte(test.line), endpoints, nil); mayStart != test.mayStart {
+			t.Errorf("%q: got %t, expected %t", test.line, mayStart, test.mayStart)
+		}
+	}
+}
+
+func TestEndpointFlags(t *testing.T) {
+	tests := []struct {
+		args      []string
+		endpoints string
+	}{
+		{nil, "[docker image create/pull]"},
+		{[]string{"-rewrite-images-create=false", "-rewrite-build"}, "[docker build]"},
+		{[]string{"-rewrite-containers-create", "-rewrite-image-inspect", "-rewrite-push"},
+			"[docker image create/pull docker container create docker image inspect docker image push]"},
+	}
+	for _, test := range tests {
+		config := printedConfig(t, nil, append(test.args, "/run/docker.sock", "/run/platformify.sock", "linux/arm64")...)
+		if endpoints := fmt.Sprint(config["endpoints"]); endpoints != test.endpoints {
+			t.Errorf("%v: got endpoints %s, expected %s", test.args, endpoints, test.endpoints)
+		}
+	}
+
+	// Requests to disabled endpoints are forwarded as is
+	daemon := &fakeDaemon{}
+	opts := testOptions(daemon)
+	opts.endpoints = []*endpoint{build}
+	proxyRequests(t, opts,
+		"POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n",
+		"POST /v1.41/build?t=app HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n")
+	_, requests, _ := daemon.received()
+	if len(requests) != 2 {
+		t.Fatalf("daemon received %d requests, expected 2", len(requests))
+	}
+	if pull, build := requests[0].URL.Query().Get("platform"), requests[1].URL.Query().Get("platform"); pull != "" || build != "linux/arm64" {
+		t.Errorf("pull sent with platform %q and build with %q", pull, build)
+	}
+}
+
+func TestHandleConnectionRewritesPush(t *testing.T) {
+	push := "POST /v1.46/images/registry.example/app/push?tag=1 HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	for _, enabled := range []bool{false, true} {
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		if enabled {
+			opts.endpoints = append(opts.endpoints, imagePush)
+		}
+		proxyRequests(t, opts, push)
+
+		_, requests, _ := daemon.received()
+		if len(requests) != 1 {
+			t.Fatalf("daemon received %d requests, expected 1", len(requests))
+		}
+		expected := "tag=1"
+		if enabled {
+			expected = "tag=1&platform=%7B%22os%22%3A%22linux%22%2C%22architecture%22%3A%22arm64%22%7D"
+		}
+		if query := requests[0].URL.RawQuery; query != expected {
+			t.Errorf("push rewriting enabled: %t: daemon received query %s, expected %s", enabled, query, expected)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Exit codes of startup failures, so that scripts can tell them apart
+const (
+	// Any failure without a more specific code
+	exitFailure = 1
+	// Invalid flags or arguments, like the flag package reports them
+	exitUsage = 2
+	// The platform, or one inferred from the proxied socket path, is invalid
+	exitInvalidPlatform = 3
+	// The proxied socket or address is already in use
+	exitSocketInUse = 4
+	// The Docker daemon can't be reached by -check-platform refuse; the proxy
+	// doesn't connect to it on startup otherwise, and starts anyway
+	exitDaemonUnreachable = 5
+	// Some file, socket or privilege change is not permitted
+	exitPermissionDenied = 6
+	// The daemon can't run containers for the platform, with -check-platform refuse
+	exitUnsupportedPlatform = 7
+)
+
+// Names of the exit codes in the machine-readable error line
+var exitReasons = map[int]string{
+	exitFailure:             "failure",
+	exitUsage:               "usage",
+	exitInvalidPlatform:     "invalid-platform",
+	exitSocketInUse:         "socket-in-use",
+	exitDaemonUnreachable:   "daemon-unreachable",
+	exitPermissionDenied:    "permission-denied",
+	exitUnsupportedPlatform: "unsupported-platform",
+}
+
+// A startup failure that maps to a specific exit code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// Tell the exit code of a startup failure, falling back to the cause of the
+// error when it doesn't carry one
+func exitCode(err error) int {
+	var exitErr *exitError
+	switch {
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	case errors.Is(err, syscall.EADDRINUSE):
+		return exitSocketInUse
+	case errors.Is(err, os.ErrPermission):
+		return exitPermissionDenied
+	}
+	return exitFailure
+}
+
+// Log a startup failure followed by a machine-readable line, e.g.
+// `error code=4 reason=socket-in-use message="..."`, then exit with its code
+func fail(err error) {
+	code := exitCode(err)
+	log.Critical(err)
+	_, _ = fmt.Fprintf(os.Stderr, "error code=%d reason=%s message=%q\n", code, exitReasons[code], err.Error())
+	os.Exit(code)
+}
+
+// Fail with a formatted error and the given exit code
+func failf(code int, format string, args ...interface{}) {
+	fail(&exitError{code, fmt.Errorf(format, args...)})
+}
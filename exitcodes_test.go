@@ -0,0 +1,108 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Serve GET /info on a Unix socket like a daemon running Windows containers
+func windowsDaemon(t *testing.T, path string) {
+	serveUnix(t, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"OSType":"windows","Architecture":"x86_64"}`))
+	}))
+}
+
+// A path the proxy isn't allowed to create a file at
+func forbiddenPath(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "read-only", "docker-platformify.pid")
+	if err := os.Mkdir(filepath.Dir(path), 0500); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getuid() == 0 {
+		// Root can write anywhere, except in pseudo file systems
+		path = "/sys/kernel/docker-platformify.pid"
+	}
+	if err := ioutil.WriteFile(path, nil, 0644); !os.IsPermission(err) {
+		if err == nil {
+			_ = os.Remove(path)
+		}
+		t.Skip("no path where creating a file isn't permitted")
+	}
+	return path
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock, proxySock := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "proxy.sock")
+	windowsDaemon(t, dockerSock)
+	notASocket := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notASocket, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		code int
+		args func() []string
+	}{
+		{"failure", exitFailure, func() []string {
+			return []string{"-access-log", dir, dockerSock, proxySock, "linux/arm64"}
+		}},
+		{"usage", exitUsage, func() []string {
+			return []string{"-listen-mode", "carrier-pigeon", dockerSock, proxySock, "linux/arm64"}
+		}},
+		{"invalid-platform", exitInvalidPlatform, func() []string {
+			return []string{dockerSock, proxySock, "arm64"}
+		}},
+		{"socket-in-use", exitSocketInUse, func() []string {
+			return []string{dockerSock, notASocket, "linux/arm64"}
+		}},
+		// Only the platform check connects to the daemon on startup
+		{"daemon-unreachable", exitDaemonUnreachable, func() []string {
+			return []string{"-check-platform", "refuse", filepath.Join(dir, "nothing.sock"), proxySock, "linux/arm64"}
+		}},
+		{"permission-denied", exitPermissionDenied, func() []string {
+			return []string{"-pidfile", forbiddenPath(t), dockerSock, proxySock, "linux/arm64"}
+		}},
+		{"unsupported-platform", exitUnsupportedPlatform, func() []string {
+			return []string{"-check-platform", "refuse", dockerSock, proxySock, "linux/arm64"}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, stderr, code := runMain(t, nil, append([]string{"-no-banner"}, test.args()...)...)
+			if code != test.code {
+				t.Errorf("exited with code %d, expected %d: %s", code, test.code, stderr)
+			}
+			if line := fmt.Sprintf("error code=%d reason=%s ", test.code, exitReasons[test.code]); !strings.Contains(stderr, line) {
+				t.Errorf("no '%s' line: %s", line, stderr)
+			}
+		})
+	}
+
+	// Failing after listening, as with the PID file, cleans up
+	if _, err := os.Stat(proxySock); !os.IsNotExist(err) {
+		t.Errorf("the proxied socket was left behind: %v", err)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Only this much of each start line, header or chunk size line is kept for
+// parsing; the rest of the line is still followed, just not looked at
+const maxFramingLine = 4096
+
+type framingState int
+
+const (
+	// Before the start line of the next message, which may be preceded by empty lines
+	framingIdle framingState = iota
+	framingStartLine
+	framingHeaders
+	// In a body of known length
+	framingBody
+	framingChunkSize
+	framingChunkData
+	// The line break at the end of the data of a chunk
+	framingChunkEnd
+	framingTrailers
+	// Everything until the connection is closed is a raw stream, e.g. after a
+	// protocol upgrade, or the body of a response of unknown length
+	framingRaw
+)
+
+// Requests after which Docker hijacks the connection for a raw stream, even
+// when the client doesn't ask for an upgrade
+var hijackingPath = regexp.MustCompile(`^(/v[0-9.]+)?/(containers/[^/]+/attach|exec/[^/]+/start)$`)
+
+// Follows the framing of the HTTP/1.x messages sent in one direction of a
+// connection, to tell where each of them ends without buffering them
+type messageFramer struct {
+	// Whether the messages are responses rather than requests
+	response bool
+	state    framingState
+	// Beginning of the line being received
+	line []byte
+	// Start line of the current message
+	startLine []byte
+	// Status code of the current response
+	status        int
+	contentLength int64
+	chunked       bool
+	upgrade       bool
+	// Bytes of the body or of the current chunk still to come
+	left int64
+
+	// Tells whether the response about to be framed has no body whatever its
+	// headers say, i.e. it answers a HEAD request; may be nil
+	bodiless func() bool
+	// Called when the start line of a message has been received; may be nil
+	onStart func(f *messageFramer)
+	// Called when a message has been received, or when its headers have for a
+	// message followed by a raw stream; may be nil
+	onEnd func(f *messageFramer)
+}
+
+// Whether the next data starts a new message
+func (f *messageFramer) idle() bool {
+	return f.state == framingIdle
+}
+
+// Whether a message has partly been received, and more of it is expected
+func (f *messageFramer) inMessage() bool {
+	return f.state != framingIdle && f.state != framingRaw
+}
+
+// Follow data sent in the direction of the framer, returning how much of it
+// belongs to the current message: it stops right after the end of a message,
+// and before the start line of the next one when empty lines come first, so
+// that the rest of the data begins with the next start line.
+func (f *messageFramer) consume(data []byte) int {
+	n := 0
+	for n < len(data) {
+		switch f.state {
+		case framingRaw:
+			return len(data)
+		case framingIdle:
+			if c := data[n]; c == '\r' || c == '\n' {
+				n++
+				continue
+			}
+			if n > 0 {
+				return n
+			}
+			f.startLine, f.status, f.contentLength, f.chunked, f.upgrade = nil, 0, -1, false, false
+			f.state = framingStartLine
+		case framingBody, framingChunkData:
+			size := int64(len(data) - n)
+			if size > f.left {
+				size = f.left
+			}
+			n += int(size)
+			f.left -= size
+			if f.left > 0 {
+				continue
+			}
+			if f.state == framingChunkData {
+				f.state = framingChunkEnd
+				continue
+			}
+			f.end()
+			return n
+		default:
+			lineEnd := bytes.IndexByte(data[n:], '\n')
+			if lineEnd < 0 {
+				f.keep(data[n:])
+				return len(data)
+			}
+			f.keep(data[n : n+lineEnd])
+			n += lineEnd + 1
+			line := bytes.TrimSuffix(f.line, []byte("\r"))
+			ended := f.parseLine(line)
+			f.line = f.line[:0]
+			if ended {
+				return n
+			}
+		}
+	}
+	return n
+}
+
+// Keep the beginning of the line being received
+func (f *messageFramer) keep(data []byte) {
+	if room := maxFramingLine - len(f.line); room < len(data) {
+		data = data[:room]
+	}
+	f.line = append(f.line, data...)
+}
+
+// Handle a complete line, returning whether it ends the message
+func (f *messageFramer) parseLine(line []byte) bool {
+	switch f.state {
+	case framingStartLine:
+		f.startLine = append([]byte{}, line...)
+		if fields := strings.Fields(string(line)); f.response && len(fields) > 1 {
+			f.status, _ = strconv.Atoi(fields[1])
+		}
+		f.state = framingHeaders
+		if f.onStart != nil {
+			f.onStart(f)
+		}
+	case framingHeaders:
+		if len(line) == 0 {
+			return f.startBody()
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon < 0 {
+			break
+		}
+		name, value := string(bytes.TrimSpace(line[:colon])), strings.ToLower(string(bytes.TrimSpace(line[colon+1:])))
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			if length, err := strconv.ParseInt(value, 10, 64); err == nil && length >= 0 {
+				f.contentLength = length
+			}
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			f.chunked = strings.HasSuffix(value, "chunked")
+		case strings.EqualFold(name, "Connection"):
+			for _, token := range strings.Split(value, ",") {
+				if strings.TrimSpace(token) == "upgrade" {
+					f.upgrade = true
+				}
+			}
+		}
+	case framingChunkSize:
+		if i := bytes.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+		switch {
+		case err != nil || size < 0:
+			// There's no telling where the message ends anymore
+			f.state = framingRaw
+		case size == 0:
+			f.state = framingTrailers
+		default:
+			f.left = size
+			f.state = framingChunkData
+		}
+	case framingChunkEnd:
+		f.state = framingChunkSize
+	case framingTrailers:
+		if len(line) == 0 {
+			f.end()
+			return true
+		}
+	}
+	return false
+}
+
+// Decide how the body of the current message is framed once its headers have
+// been received, returning whether the message has already ended
+func (f *messageFramer) startBody() bool {
+	if f.response {
+		switch {
+		case f.status == 101:
+			f.raw()
+			return true
+		case f.status >= 100 && f.status < 200, f.status == 204, f.status == 304,
+			f.bodiless != nil && f.bodiless():
+			f.end()
+			return true
+		case !f.chunked && f.contentLength < 0:
+			// The body lasts until the connection is closed
+			f.raw()
+			return true
+		}
+	} else if f.upgrade || hijackingPath.Match(requestPath(f.startLine)) {
+		f.raw()
+		return true
+	}
+
+	switch {
+	case f.chunked:
+		f.state = framingChunkSize
+	case f.contentLength > 0:
+		f.left = f.contentLength
+		f.state = framingBody
+	default:
+		f.end()
+		return true
+	}
+	return false
+}
+
+func (f *messageFramer) end() {
+	f.state = framingIdle
+	if f.onEnd != nil {
+		f.onEnd(f)
+	}
+}
+
+// End the message, and follow the rest of the connection as a raw stream
+func (f *messageFramer) raw() {
+	f.end()
+	f.state = framingRaw
+}
+
+// Get the path of a request line, without the query
+func requestPath(requestLine []byte) []byte {
+	start, end, err := parseRequestLine(requestLine)
+	if err != nil {
+		return nil
+	}
+	path := requestLine[start:end]
+	if i := bytes.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// A request forwarded to the daemon, waiting for its response
+type exchange struct {
+	// Whether the request is a HEAD one, whose response has no body
+	head bool
+	// Called once the response has been received, before its end is forwarded
+	// to the client; may be nil
+	done func(status int)
+	// Platform to report in the response to an image inspect request, if it
+	// must be rewritten
+	inspectPlatform string
+	// Response sent by the proxy itself once the previous ones have been
+	// forwarded, when the request was rejected; the connection is closed after
+	// it
+	reply []byte
+}
+
+// Requests of a connection waiting for their responses, in order; they are
+// added by the client direction and removed by the daemon one
+type exchangeQueue struct {
+	mu        sync.Mutex
+	exchanges []*exchange
+}
+
+func (q *exchangeQueue) push(e *exchange) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.exchanges = append(q.exchanges, e)
+}
+
+// Get the oldest request waiting for its response, or nil if there's none
+func (q *exchangeQueue) peek() *exchange {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.exchanges) == 0 {
+		return nil
+	}
+	return q.exchanges[0]
+}
+
+// Remove the oldest request waiting for its response, returning it, or nil
+// if there's none
+func (q *exchangeQueue) pop() *exchange {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.exchanges) == 0 {
+		return nil
+	}
+	e := q.exchanges[0]
+	q.exchanges = q.exchanges[1:]
+	return e
+}
+
+func (q *exchangeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.exchanges)
+}
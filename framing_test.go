@@ -0,0 +1,204 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Feed data to the framer in pieces of the given size, returning the messages
+// it delimits, without the empty lines before them, and whatever is left over,
+// e.g. a raw stream
+func frameMessages(f *messageFramer, data []byte, pieceSize int) (messages []string, rest string) {
+	var current []byte
+	for len(data) > 0 {
+		piece := data
+		if len(piece) > pieceSize {
+			piece = piece[:pieceSize]
+		}
+		for len(piece) > 0 {
+			wasIdle, wasRaw := f.idle(), f.state == framingRaw
+			n := f.consume(piece)
+			if wasIdle && f.idle() && strings.Trim(string(piece[:n]), "\r\n") == "" {
+				// Only empty lines
+				piece, data = piece[n:], data[n:]
+				continue
+			}
+			current = append(current, piece[:n]...)
+			piece, data = piece[n:], data[n:]
+			if f.idle() || f.state == framingRaw && !wasRaw {
+				messages = append(messages, string(current))
+				current = nil
+			}
+		}
+	}
+	return messages, string(current)
+}
+
+func TestMessageFramerRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		rest     string
+		state    framingState
+	}{
+		{
+			name:     "without body",
+			messages: []string{"GET /v1.41/info HTTP/1.1\r\nHost: docker\r\n\r\n"},
+		},
+		{
+			name: "with content length",
+			messages: []string{
+				"POST /v1.41/build HTTP/1.1\r\nContent-Length: 50\r\n\r\n\nPOST /images/create?fromImage=evil HTTP/1.1\r\n\r\n..",
+				"POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\n\r\n",
+			},
+		},
+		{
+			name: "chunked",
+			messages: []string{
+				"POST /v1.41/build HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+					"6\r\n\nGET /\r\n2;name=value\r\nab\r\n0\r\nX-Trailer: 1\r\n\r\n",
+				"GET /v1.41/images/json HTTP/1.1\r\n\r\n",
+			},
+		},
+		{
+			name:     "headers in any case",
+			messages: []string{"POST /build HTTP/1.1\r\ncontent-length:  3\r\n\r\nabc"},
+		},
+		{
+			name:     "bare line feeds",
+			messages: []string{"POST /build HTTP/1.1\nContent-Length: 1\n\nx", "GET /info HTTP/1.1\n\n"},
+		},
+		{
+			name:  "upgrade",
+			rest:  "abc\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+			state: framingRaw,
+			messages: []string{
+				"POST /v1.41/containers/abc/attach?stream=1 HTTP/1.1\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n",
+			},
+		},
+		{
+			name:     "hijacked without upgrade",
+			rest:     "GET / HTTP/1.1\r\n\r\n",
+			state:    framingRaw,
+			messages: []string{"POST /exec/abc/start HTTP/1.1\r\nContent-Length: 0\r\n\r\n"},
+		},
+		{
+			name:     "incomplete body",
+			messages: []string{"GET /info HTTP/1.1\r\n\r\n"},
+			rest:     "POST /build HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc",
+			state:    framingBody,
+		},
+	}
+
+	for _, test := range tests {
+		data := "\r\n" + strings.Join(test.messages, "") + test.rest
+		for _, pieceSize := range []int{1, 7, len(data)} {
+			f := &messageFramer{}
+			var started []string
+			f.onStart = func(f *messageFramer) { started = append(started, string(f.startLine)) }
+			messages, rest := frameMessages(f, []byte(data), pieceSize)
+			if !reflect.DeepEqual(messages, test.messages) || rest != test.rest {
+				t.Errorf("%s in pieces of %d: got messages %q and rest %q, expected %q and %q",
+					test.name, pieceSize, messages, rest, test.messages, test.rest)
+			}
+			if f.state != test.state {
+				t.Errorf("%s in pieces of %d: ended in state %d, expected %d", test.name, pieceSize, f.state, test.state)
+			}
+			starts := len(test.messages)
+			if test.state != framingIdle && test.state != framingRaw {
+				starts++
+			}
+			if len(started) != starts {
+				t.Errorf("%s in pieces of %d: saw start lines %q", test.name, pieceSize, started)
+			}
+		}
+	}
+}
+
+func TestMessageFramerResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     bool
+		messages []string
+		rest     string
+		state    framingState
+	}{
+		{
+			name: "with content length and chunked",
+			messages: []string{
+				"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n{}",
+				"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\n{}\n\r\n0\r\n\r\n",
+			},
+		},
+		{
+			name:     "without body",
+			messages: []string{"HTTP/1.1 204 No Content\r\n\r\n", "HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n"},
+		},
+		{
+			name:     "interim",
+			messages: []string{"HTTP/1.1 100 Continue\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+		},
+		{
+			name:     "answering HEAD",
+			head:     true,
+			messages: []string{"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n"},
+		},
+		{
+			name:     "switching protocols",
+			messages: []string{"HTTP/1.1 101 UPGRADED\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n"},
+			rest:     "\x01\x00\x00\x00\x00\x00\x00\x02hi",
+			state:    framingRaw,
+		},
+		{
+			name:     "until closed",
+			messages: []string{"HTTP/1.0 200 OK\r\n\r\n"},
+			rest:     "HTTP/1.1 200 OK\r\n\r\n",
+			state:    framingRaw,
+		},
+		{
+			name:  "incomplete",
+			rest:  "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n{",
+			state: framingBody,
+		},
+	}
+
+	for _, test := range tests {
+		data := strings.Join(test.messages, "") + test.rest
+		for _, pieceSize := range []int{1, 7, len(data)} {
+			head := test.head
+			f := &messageFramer{response: true, bodiless: func() bool { return head }}
+			var statuses []int
+			f.onEnd = func(f *messageFramer) { statuses = append(statuses, f.status) }
+			messages, rest := frameMessages(f, []byte(data), pieceSize)
+			if !reflect.DeepEqual(messages, test.messages) || rest != test.rest {
+				t.Errorf("%s in pieces of %d: got messages %q and rest %q, expected %q and %q",
+					test.name, pieceSize, messages, rest, test.messages, test.rest)
+			}
+			if f.state != test.state {
+				t.Errorf("%s in pieces of %d: ended in state %d, expected %d", test.name, pieceSize, f.state, test.state)
+			}
+			if len(statuses) != len(test.messages) || len(statuses) > 0 && statuses[0] == 0 {
+				t.Errorf("%s in pieces of %d: ended responses with statuses %v", test.name, pieceSize, statuses)
+			}
+			if f.inMessage() != (test.state != framingIdle && test.state != framingRaw) {
+				t.Errorf("%s in pieces of %d: inMessage() is %t", test.name, pieceSize, f.inMessage())
+			}
+		}
+	}
+}
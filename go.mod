@@ -1,5 +1,5 @@
 module github.com/Depau/docker-platformify
 
-go 1.14
+go 1.16
 
 require github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
@@ -0,0 +1,88 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Parse a socket address in the format of DOCKER_HOST, e.g. "unix:///var/run/docker.sock",
+// "tcp://127.0.0.1:2375" or "fd://3", into a network and an address to use
+// with it. Addresses without a scheme are Unix socket paths. The network is
+// "fd" for file descriptors, with the descriptor number as the address;
+// "fd://" alone stands for the first socket passed by systemd.
+func parseHost(host string) (network string, address string, err error) {
+	i := strings.Index(host, "://")
+	if i < 0 {
+		return "unix", host, nil
+	}
+	scheme, address := host[:i], host[i+len("://"):]
+
+	switch scheme {
+	case "unix":
+		if address == "" {
+			return "", "", fmt.Errorf("'%s' doesn't have a socket path", host)
+		}
+		return "unix", address, nil
+	case "tcp":
+		if address == "" {
+			return "", "", fmt.Errorf("'%s' doesn't have a host", host)
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			// Like Docker, default to the port of the unencrypted API
+			address = net.JoinHostPort(strings.Trim(address, "[]"), "2375")
+		}
+		return "tcp", strings.TrimSuffix(address, "/"), nil
+	case "fd":
+		if address == "" {
+			return "fd", "3", nil
+		}
+		if fd, err := strconv.Atoi(address); err != nil || fd < 0 {
+			return "", "", fmt.Errorf("'%s' isn't a valid file descriptor", address)
+		}
+		return "fd", address, nil
+	case "npipe":
+		return "", "", fmt.Errorf("'%s': named pipes are only available on Windows, which isn't supported", host)
+	default:
+		return "", "", fmt.Errorf("'%s' has an unsupported scheme, expected unix://, tcp:// or fd://", host)
+	}
+}
+
+// Check whether a TCP address only accepts connections from this host: its IP,
+// or every IP its host name resolves to, must be a loopback one. An empty host
+// stands for every interface.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestParseHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		network string
+		address string
+		valid   bool
+	}{
+		{"/var/run/docker.sock", "unix", "/var/run/docker.sock", true},
+		{"unix:///var/run/docker.sock", "unix", "/var/run/docker.sock", true},
+		{"tcp://127.0.0.1:2376", "tcp", "127.0.0.1:2376", true},
+		{"tcp://127.0.0.1", "tcp", "127.0.0.1:2375", true},
+		{"tcp://[::1]", "tcp", "[::1]:2375", true},
+		{"tcp://localhost:2375/", "tcp", "localhost:2375", true},
+		{"fd://", "fd", "3", true},
+		{"fd://4", "fd", "4", true},
+		{host: "unix://"},
+		{host: "tcp://"},
+		{host: "fd://-1"},
+		{host: "fd://socket"},
+		{host: "npipe:////./pipe/docker_engine"},
+		{host: "ssh://user@host"},
+	}
+
+	for _, test := range tests {
+		network, address, err := parseHost(test.host)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, expected the host to be valid: %t", test.host, err, test.valid)
+		} else if test.valid && (network != test.network || address != test.address) {
+			t.Errorf("%s: got %s %s, expected %s %s", test.host, network, address, test.network, test.address)
+		}
+	}
+}
+
+func TestIsLoopbackAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		loopback bool
+	}{
+		{"127.0.0.1:2375", true},
+		{"127.1.2.3:2375", true},
+		{"[::1]:2375", true},
+		{"0.0.0.0:2375", false},
+		{":2375", false},
+		{"192.0.2.1:2375", false},
+		{"[::]:2375", false},
+		{"127.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		if loopback := isLoopbackAddress(test.address); loopback != test.loopback {
+			t.Errorf("%s: got %t, expected %t", test.address, loopback, test.loopback)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Inspect responses larger than this can't be rewritten
+const maxInspectResponseSize = 16 << 20
+
+// Get the image inspected by an image inspect request line, e.g.
+// "GET /v1.41/images/alpine:3.19/json"
+func inspectedImage(requestLine []byte) string {
+	urlStart, urlEnd, err := parseRequestLine(requestLine)
+	if err != nil {
+		return ""
+	}
+	u, err := url.Parse(string(requestLine[urlStart:urlEnd]))
+	if err != nil {
+		return ""
+	}
+	i := strings.Index(u.Path, "/images/")
+	if i < 0 {
+		return ""
+	}
+	image := u.Path[i+len("/images/"):]
+	if !strings.HasSuffix(image, "/json") {
+		return ""
+	}
+	return strings.TrimSuffix(image, "/json")
+}
+
+// Pick the platform reported in the response to an image inspect request line,
+// the way it would be picked when pulling the image
+func inspectPlatform(opts *options, requestLine []byte, auth string) string {
+	if opts.allowPlatformOverride {
+		if override, _, err := takePlatformOverride(requestLine); err == nil && override != "" {
+			return override
+		}
+	}
+	image := inspectedImage(requestLine)
+	if image == "" {
+		return opts.platform
+	}
+	if r := matchRule(opts.rules, image); r != nil && r.action == "platform" {
+		return r.platform
+	}
+	if len(opts.platformPreference) > 0 {
+		return preferredImagePlatform(opts, image, auth)
+	}
+	return opts.platform
+}
+
+// Rewrite the image inspect response starting with data, reading the rest of it
+// from conn
+func rewriteResponseFrom(conn net.Conn, data []byte, platform string) ([]byte, error) {
+	// Let the rest of the response arrive
+	if err := conn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return nil, err
+	}
+	rewritten, err := rewriteInspectResponse(io.MultiReader(bytes.NewReader(data), conn), platform)
+	// Don't leave the longer deadline behind for whoever reads next
+	if deadlineErr := conn.SetReadDeadline(time.Time{}); err == nil {
+		err = deadlineErr
+	}
+	return rewritten, err
+}
+
+// Read an image inspect response from r and rewrite its platform fields so that
+// they match the injected platform. Anything read past the response is returned
+// as well so that it can be forwarded.
+func rewriteInspectResponse(r io.Reader, platform string) ([]byte, error) {
+	reader := bufio.NewReader(r)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxInspectResponseSize+1))
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxInspectResponseSize {
+		return nil, errors.New("image inspect response is too large")
+	}
+
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var inspect map[string]json.RawMessage
+		if err := json.Unmarshal(body, &inspect); err == nil {
+			os, arch, variant := splitPlatform(platform)
+			inspect["Os"], _ = json.Marshal(os)
+			inspect["Architecture"], _ = json.Marshal(arch)
+			if variant != "" {
+				inspect["Variant"], _ = json.Marshal(variant)
+			}
+			if body, err = json.Marshal(inspect); err != nil {
+				return nil, err
+			}
+			log.Info("rewrote platform in image inspect response")
+		} else {
+			log.Warning("unable to parse image inspect response, sending as is:", err)
+		}
+	}
+
+	// Re-frame the response for the new body
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	var out bytes.Buffer
+	if err := resp.Write(&out); err != nil {
+		return nil, err
+	}
+
+	leftovers, _ := reader.Peek(reader.Buffered())
+	out.Write(leftovers)
+	return out.Bytes(), nil
+}
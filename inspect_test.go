@@ -0,0 +1,201 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A daemon answering image inspect and version requests for an amd64 host
+func inspectDaemon() *fakeDaemon {
+	return &fakeDaemon{reply: func(_ int, req *http.Request) (string, bool) {
+		body := `{"Id":"sha256:1234","Os":"linux","Architecture":"amd64"}`
+		if strings.HasSuffix(req.URL.Path, "/version") {
+			body = `{"Version":"24.0.0","Os":"linux","Arch":"amd64"}`
+		}
+		return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body), false
+	}}
+}
+
+// Send requests at once through a connection served by handleConnection, and
+// decode the JSON responses
+func proxyPipelined(t *testing.T, opts *options, requests ...string) []map[string]string {
+	t.Helper()
+	var responses []map[string]string
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		if _, err := client.Write([]byte(strings.Join(requests, ""))); err != nil {
+			t.Fatal("unable to send requests:", err)
+		}
+		for range requests {
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal("unable to read response:", err)
+			}
+			fields := map[string]string{}
+			err = json.NewDecoder(resp.Body).Decode(&fields)
+			_ = resp.Body.Close()
+			if err != nil {
+				t.Fatal("unable to decode response:", err)
+			}
+			responses = append(responses, fields)
+		}
+	})
+	return responses
+}
+
+func TestInspectedImage(t *testing.T) {
+	tests := []struct {
+		line  string
+		image string
+	}{
+		{"GET /v1.41/images/alpine:3.19/json HTTP/1.1\r", "alpine:3.19"},
+		{"GET /images/quay.io/org/app/json?x=1 HTTP/1.1", "quay.io/org/app"},
+		{"GET /v1.41/images/json HTTP/1.1", ""},
+		{"GET /v1.41/images/alpine/history HTTP/1.1", ""},
+	}
+	for _, test := range tests {
+		if image := inspectedImage([]byte(test.line)); image != test.image {
+			t.Errorf("inspectedImage(%q) = %q, expected %q", test.line, image, test.image)
+		}
+	}
+}
+
+func TestRewriteInspectResponse(t *testing.T) {
+	daemon := inspectDaemon()
+	opts := testOptions(daemon)
+	opts.rewriteInspectResponse = true
+	opts.allowPlatformOverride = true
+	opts.rules = []*rule{{action: "platform", registry: wildcardPattern("docker.io"), image: wildcardPattern("library/busybox*"), platform: "linux/arm/v7"}}
+
+	responses := proxyPipelined(t, opts,
+		"GET /v1.41/version HTTP/1.1\r\nHost: docker\r\n\r\n",
+		"GET /v1.41/images/alpine:latest/json HTTP/1.1\r\nHost: docker\r\n\r\n",
+		"GET /v1.41/images/busybox/json HTTP/1.1\r\nHost: docker\r\n\r\n",
+		"GET /v1.41/images/alpine/json?__platformify=linux/s390x HTTP/1.1\r\nHost: docker\r\n\r\n",
+		"GET /v1.41/version HTTP/1.1\r\nHost: docker\r\n\r\n")
+
+	expected := []map[string]string{
+		// Not an image inspect request
+		{"Version": "24.0.0", "Os": "linux", "Arch": "amd64"},
+		// The configured platform
+		{"Id": "sha256:1234", "Os": "linux", "Architecture": "arm64"},
+		// The platform picked by a rule
+		{"Id": "sha256:1234", "Os": "linux", "Architecture": "arm", "Variant": "v7"},
+		// The platform picked by the client
+		{"Id": "sha256:1234", "Os": "linux", "Architecture": "s390x"},
+		{"Version": "24.0.0", "Os": "linux", "Arch": "amd64"},
+	}
+	if len(responses) != len(expected) {
+		t.Fatalf("got %d responses, expected %d", len(responses), len(expected))
+	}
+	for i := range expected {
+		if fmt.Sprint(responses[i]) != fmt.Sprint(expected[i]) {
+			t.Errorf("response %d is %v, expected %v", i, responses[i], expected[i])
+		}
+	}
+}
+
+func TestHandleConnectionInjectsIntoImageInspect(t *testing.T) {
+	daemon := &fakeDaemon{}
+	opts := testOptions(daemon)
+	opts.endpoints = []*endpoint{imagesCreate, imageInspect}
+	proxyRequests(t, opts,
+		"GET /v1.49/images/ghcr.io/owner/app:1/json HTTP/1.1\r\nHost: docker\r\n\r\n",
+		"GET /v1.49/images/json HTTP/1.1\r\nHost: docker\r\n\r\n",
+		"POST /v1.49/images/alpine/json HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n")
+
+	_, requests, _ := daemon.received()
+	if len(requests) != 3 {
+		t.Fatalf("daemon received %d requests, expected 3", len(requests))
+	}
+	if got := requests[0].URL.Query().Get("platform"); got != `{"os":"linux","architecture":"arm64"}` {
+		t.Errorf("image inspect was sent with platform %q", got)
+	}
+	if requests[0].URL.Path != "/v1.49/images/ghcr.io/owner/app:1/json" {
+		t.Errorf("image inspect was sent to %s", requests[0].URL.Path)
+	}
+	// Neither the image list nor other methods are image inspect requests
+	for _, req := range requests[1:] {
+		if req.URL.RawQuery != "" {
+			t.Errorf("%s %s was rewritten", req.Method, req.URL)
+		}
+	}
+}
+
+func TestRewriteInspectResponseOfInjectedRequest(t *testing.T) {
+	daemon := inspectDaemon()
+	opts := testOptions(daemon)
+	opts.rewriteInspectResponse = true
+	opts.allowPlatformOverride = true
+	opts.endpoints = []*endpoint{imagesCreate, imageInspect}
+
+	responses := proxyPipelined(t, opts, "GET /v1.44/images/alpine/json?__platformify=linux/ppc64le HTTP/1.1\r\nHost: docker\r\n\r\n")
+	if arch := responses[0]["Architecture"]; arch != "ppc64le" {
+		t.Errorf("response reports architecture %s, expected ppc64le", arch)
+	}
+	_, requests, _ := daemon.received()
+	if len(requests) != 1 {
+		t.Fatalf("daemon received %d requests, expected 1", len(requests))
+	}
+	query := requests[0].URL.Query()
+	if query.Get("platform") != `{"os":"linux","architecture":"ppc64le"}` || query.Get(platformOverrideParam) != "" {
+		t.Errorf("daemon was asked about %s", requests[0].URL)
+	}
+}
+
+func TestRewriteResponseFromClearsDeadline(t *testing.T) {
+	conn, daemon, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer daemon.Close()
+
+	body := `{"Os":"linux","Architecture":"amd64"}`
+	response := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	// The rest of the response arrives later
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.WriteString(daemon, response[10:])
+	}()
+	rewritten, err := rewriteResponseFrom(conn, []byte(response[:10]), "linux/arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rewritten), `"Architecture":"arm64"`) {
+		t.Errorf("response wasn't rewritten: %q", rewritten)
+	}
+
+	// Reading waits for the daemon, however long it takes
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		read <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_ = daemon.Close()
+	if err := <-read; err != io.EOF {
+		t.Errorf("reading failed with %v, expected EOF", err)
+	}
+}
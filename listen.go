@@ -0,0 +1,156 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Adopt an already open listening socket inherited from the parent process
+func listenOnFd(fd int) (net.Listener, error) {
+	acceptConn, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not a socket: %v", fd, err)
+	}
+	if acceptConn == 0 {
+		return nil, fmt.Errorf("socket at file descriptor %d is not listening", fd)
+	}
+
+	// FileListener duplicates the descriptor, so the file can be closed right away
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// Pick the path of the proxy socket: abstract socket names, starting with "@",
+// are replaced with the fallback path on systems that don't support them
+func proxySocketPath(path string, fallback string) (string, error) {
+	if !isAbstract(path) || abstractSocketsSupported {
+		return path, nil
+	}
+	if fallback == "" {
+		return "", fmt.Errorf("abstract socket '%s' is not supported on this system and no fallback path was given", path)
+	}
+	log.Noticef("abstract sockets are not supported on this system, using '%s' instead of '%s'", fallback, path)
+	return fallback, nil
+}
+
+// Check whether a Unix socket address names an abstract socket, e.g.
+// "@docker-platformify", rather than a path
+func isAbstract(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// Longest path that fits in a Unix socket address, leaving room for the
+// terminating NUL byte
+var maxUnixSocketPath = len(syscall.RawSockaddrUnix{}.Path) - 1
+
+// Listen on a Unix socket; unlike net.Listen, which always uses the system
+// limit, this allows setting a custom backlog. The socket is created with the
+// given umask, unless it's negative, so that it never has wider permissions
+// than intended, not even briefly.
+func listenUnix(path string, backlog int, umask int) (net.Listener, error) {
+	if len(path) > maxUnixSocketPath {
+		return nil, fmt.Errorf("proxy socket path '%s' is %d bytes long, Unix sockets are limited to %d; "+
+			"use a shorter path or pass an already open socket with -listen-fd", path, len(path), maxUnixSocketPath)
+	}
+	if umask >= 0 {
+		// The umask applies to the whole process, which doesn't create other files meanwhile
+		previous := syscall.Umask(umask)
+		defer syscall.Umask(previous)
+	}
+	if backlog <= 0 {
+		return net.Listen("unix", path)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	file := os.NewFile(uintptr(fd), path)
+	defer file.Close()
+
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		_ = os.Remove(path)
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	ln, err := net.FileListener(file)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Set the size of the kernel receive and send buffers of a socket; sizes of 0
+// keep the system default
+func setBufferSizes(rawConn syscall.RawConn, rcvBuf, sndBuf int) error {
+	var sockErr error
+	err := rawConn.Control(func(fd uintptr) {
+		if rcvBuf > 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvBuf); err != nil {
+				sockErr = os.NewSyscallError("setsockopt SO_RCVBUF", err)
+				return
+			}
+		}
+		if sndBuf > 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndBuf); err != nil {
+				sockErr = os.NewSyscallError("setsockopt SO_SNDBUF", err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Apply the buffer sizes to an already established connection
+func setConnBufferSizes(conn net.Conn, rcvBuf, sndBuf int) error {
+	if rcvBuf <= 0 && sndBuf <= 0 {
+		return nil
+	}
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("connection of type %T does not support socket options", conn)
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setBufferSizes(rawConn, rcvBuf, sndBuf)
+}
+
+// Enable or disable Nagle's algorithm (TCP_NODELAY) on a TCP connection,
+// including one tunneled through an HTTP proxy; other connections are left alone
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	if buffered, ok := conn.(*bufferedConn); ok {
+		conn = buffered.Conn
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		return tcpConn.SetNoDelay(noDelay)
+	}
+	return nil
+}
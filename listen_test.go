@@ -0,0 +1,298 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixUmask(t *testing.T) {
+	previous := syscall.Umask(0022)
+	defer syscall.Umask(previous)
+
+	for _, backlog := range []int{0, 16} {
+		path := filepath.Join(t.TempDir(), "proxy.sock")
+		ln, err := listenUnix(path, backlog, 0077)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		_ = ln.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0700 {
+			t.Errorf("backlog %d: socket created with mode %o, expected 700", backlog, mode)
+		}
+		if umask := syscall.Umask(0022); umask != 0022 {
+			t.Errorf("backlog %d: umask left at %o, expected 022 to be restored", backlog, umask)
+		}
+	}
+}
+
+func TestListenUmaskIgnoredForTCP(t *testing.T) {
+	dockerSock := filepath.Join(t.TempDir(), "docker.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	_, log := startProxy(t, nil, "-no-banner", "-listen-umask", "007", dockerSock, "tcp://127.0.0.1:0", "linux/arm64")
+	log.waitFor(t, "-listen-umask only applies to Unix sockets")
+	log.waitFor(t, "listening on proxy address")
+}
+
+func TestListenOnFd(t *testing.T) {
+	dir := t.TempDir()
+	ln, err := net.Listen("unix", filepath.Join(dir, "inherited.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	file, err := ln.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The adopted descriptor is closed by listenOnFd
+	fd, err := syscall.Dup(int(file.Fd()))
+	_ = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adopted, err := listenOnFd(fd)
+	if err != nil {
+		t.Fatal("unable to adopt listening socket:", err)
+	}
+	defer adopted.Close()
+	conn, err := net.Dial("unix", filepath.Join(dir, "inherited.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := adopted.Accept()
+	if err != nil {
+		t.Fatal("unable to accept on adopted socket:", err)
+	}
+	_ = accepted.Close()
+
+	regular, err := os.Create(filepath.Join(dir, "regular"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regular.Close()
+	if _, err := listenOnFd(int(regular.Fd())); err == nil || !strings.Contains(err.Error(), "is not a socket") {
+		t.Errorf("got error %v for a regular file, expected it not to be a socket", err)
+	}
+
+	notListening, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(notListening)
+	if _, err := listenOnFd(notListening); err == nil || !strings.Contains(err.Error(), "is not listening") {
+		t.Errorf("got error %v for a socket that isn't listening, expected it not to be listening", err)
+	}
+}
+
+func TestListenUnixBacklog(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("how full queues are reported depends on the system")
+	}
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	const backlog = 2
+	ln, err := listenUnix(path, backlog, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Nothing is accepted, so connections are refused once the queue is full
+	var connected int
+	for i := 0; i < backlog+8; i++ {
+		fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(fd)
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Connect(fd, &syscall.SockaddrUnix{Name: path}); err == syscall.EAGAIN {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		connected++
+	}
+	// The kernel lets one more connection than the backlog through
+	if connected != backlog+1 {
+		t.Errorf("queued %d connections with a backlog of %d", connected, backlog)
+	}
+}
+
+func TestListenUnixPathTooLong(t *testing.T) {
+	path := filepath.Join(t.TempDir(), strings.Repeat("x", maxUnixSocketPath)+".sock")
+	_, err := listenUnix(path, 0, -1)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("limited to %d", maxUnixSocketPath)) ||
+		!strings.Contains(err.Error(), "-listen-fd") {
+		t.Errorf("got error %v for a %d bytes long path", err, len(path))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("something was created at the path: %v", err)
+	}
+}
+
+// Read an integer socket option of a connection
+func socketOption(t *testing.T, conn net.Conn, level int, option int) int {
+	t.Helper()
+	rawConn, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, option)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return value
+}
+
+func TestSocketBufferSizes(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("how buffer sizes are reported depends on the system")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	opts := &options{dockerNetwork: "tcp", dockerSock: ln.Addr().String(), rcvBuf: 65536, sndBuf: 32768}
+	conn, err := opts.dialDocker(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if err := setConnBufferSizes(accepted, opts.rcvBuf, opts.sndBuf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Linux doubles the requested sizes to make room for its bookkeeping
+	for name, c := range map[string]net.Conn{"dialed": conn, "accepted": accepted} {
+		if rcvBuf := socketOption(t, c, syscall.SOL_SOCKET, syscall.SO_RCVBUF); rcvBuf != 2*opts.rcvBuf {
+			t.Errorf("%s connection has SO_RCVBUF %d, expected %d", name, rcvBuf, 2*opts.rcvBuf)
+		}
+		if sndBuf := socketOption(t, c, syscall.SOL_SOCKET, syscall.SO_SNDBUF); sndBuf != 2*opts.sndBuf {
+			t.Errorf("%s connection has SO_SNDBUF %d, expected %d", name, sndBuf, 2*opts.sndBuf)
+		}
+	}
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, noDelay := range []bool{false, true} {
+		opts := &options{dockerNetwork: "tcp", dockerSock: ln.Addr().String(), tcpNoDelay: noDelay}
+		conn, err := opts.dialDocker(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		accepted, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer accepted.Close()
+		// As with a connection tunneled through an HTTP proxy
+		if err := setNoDelay(&bufferedConn{Conn: accepted}, noDelay); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, c := range map[string]net.Conn{"dialed": conn, "accepted": accepted} {
+			if set := socketOption(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0; set != noDelay {
+				t.Errorf("-tcp-nodelay=%t: %s connection has TCP_NODELAY set: %t", noDelay, name, set)
+			}
+		}
+	}
+
+	// Nothing to do for Unix sockets
+	client, proxied, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer proxied.Close()
+	if err := setNoDelay(proxied, true); err != nil {
+		t.Errorf("got error %v setting TCP_NODELAY on a Unix socket", err)
+	}
+}
+
+func TestProxySocketPath(t *testing.T) {
+	fallback := filepath.Join(t.TempDir(), "fallback.sock")
+	if path, err := proxySocketPath("/run/platformify.sock", fallback); err != nil || path != "/run/platformify.sock" {
+		t.Errorf("got %q and error %v for a filesystem path", path, err)
+	}
+
+	abstract := fmt.Sprintf("@docker-platformify-test-%d", os.Getpid())
+	path, err := proxySocketPath(abstract, fallback)
+	_, errWithoutFallback := proxySocketPath(abstract, "")
+	if abstractSocketsSupported {
+		if err != nil || path != abstract || errWithoutFallback != nil {
+			t.Fatalf("got %q and error %v for an abstract socket, %v without fallback", path, err, errWithoutFallback)
+		}
+		// Nothing shows up in the filesystem
+		ln, err := listenUnix(path, 0, -1)
+		if err != nil {
+			t.Fatal("unable to listen on abstract socket:", err)
+		}
+		defer ln.Close()
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal("unable to connect to abstract socket:", err)
+		}
+		_ = conn.Close()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("abstract socket found in the filesystem: %v", err)
+		}
+	} else {
+		if err != nil || path != fallback {
+			t.Errorf("got %q and error %v, expected the fallback path", path, err)
+		}
+		if errWithoutFallback == nil {
+			t.Error("an abstract socket was accepted without fallback on a system not supporting them")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// Formats log lines starting with the name of the function logging them.
+// Unlike %{shortfunc}, lines logged by closures, e.g. by the goroutines started
+// by handleConnection, show the function they are defined in rather than names
+// like "func3".
+type callerFormatter struct {
+	colored logging.Formatter
+	rest    logging.Formatter
+}
+
+// Create a formatter for lines made of the function name followed by format
+func newCallerFormatter(format string) logging.Formatter {
+	return &callerFormatter{
+		colored: logging.MustStringFormatter("%{color}"),
+		rest:    logging.MustStringFormatter(format),
+	}
+}
+
+func (f *callerFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	if err := f.colored.Format(calldepth+1, r, w); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%-15.15s", logCaller(calldepth)); err != nil {
+		return err
+	}
+	return f.rest.Format(calldepth+1, r, w)
+}
+
+// Get the name of the function that logged a record, given the call depth
+// passed to formatters and backends; -log-caller-depth skips more frames
+func logCaller(calldepth int) string {
+	pc, _, _, ok := runtime.Caller(calldepth + 2)
+	if !ok {
+		return "???"
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return "???"
+	}
+	// e.g. "main.handleConnection.func3.1" or "main.(*tracer).export"
+	name := fn.Name()
+	parts := strings.Split(name[strings.LastIndex(name, "/")+1:], ".")
+	for _, part := range parts[1:] {
+		// Receiver types come first, closures after the function
+		if !strings.HasPrefix(part, "(") {
+			return part
+		}
+	}
+	return "???"
+}
+
+// Switch between the configured log level and DEBUG whenever SIGUSR1 is
+// received, to troubleshoot without restarting. The signal is caught before
+// returning, so that it can't terminate the process anymore.
+func toggleDebugOnSignal(configured logging.Level) {
+	if configured == logging.DEBUG {
+		configured = logging.INFO
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			level := logging.DEBUG
+			if logging.GetLevel("docker-platformify") == logging.DEBUG {
+				level = configured
+			}
+			logging.SetLevel(level, "docker-platformify")
+			log.Notice("log level set to", level)
+		}
+	}()
+}
@@ -0,0 +1,272 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// Receives everything logged at the info level or above during the tests
+var testLogs = &logRecorder{}
+
+// Record what's logged at a level at least as severe as the given one, and
+// at most as verbose as info, for the rest of the test
+func recordLogs(t *testing.T, level logging.Level) *logRecorder {
+	testLogs.start(level)
+	t.Cleanup(testLogs.stop)
+	return testLogs
+}
+
+// A logging backend keeping the records in memory while recording
+type logRecorder struct {
+	mu        sync.Mutex
+	recording bool
+	level     logging.Level
+	records   []loggedRecord
+}
+
+type loggedRecord struct {
+	level   logging.Level
+	message string
+	// Function shown in the log line
+	caller string
+}
+
+func (r *logRecorder) start(level logging.Level) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recording, r.level, r.records = true, level, nil
+}
+
+func (r *logRecorder) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recording = false
+}
+
+func (r *logRecorder) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// More severe levels are lower
+	if r.recording && level <= r.level {
+		r.records = append(r.records, loggedRecord{level, record.Message(), logCaller(calldepth)})
+	}
+	return nil
+}
+
+// Get the messages logged at a level at least as severe as the given one,
+// which contain substring
+func (r *logRecorder) messages(level logging.Level, substring string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var messages []string
+	for _, record := range r.records {
+		// More severe levels are lower
+		if record.level <= level && strings.Contains(record.message, substring) {
+			messages = append(messages, record.message)
+		}
+	}
+	return messages
+}
+
+// Get the functions shown for the messages containing substring
+func (r *logRecorder) callers(substring string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var callers []string
+	for _, record := range r.records {
+		if strings.Contains(record.message, substring) {
+			callers = append(callers, record.caller)
+		}
+	}
+	return callers
+}
+
+// Check whether a message containing substring was logged at a level at
+// least as severe as the given one
+func (r *logRecorder) contains(level logging.Level, substring string) bool {
+	return len(r.messages(level, substring)) > 0
+}
+
+func TestRecordLogs(t *testing.T) {
+	logs := recordLogs(t, logging.INFO)
+	daemon := &fakeDaemon{}
+	proxyRequests(t, testOptions(daemon), "POST /v1.41/images/create?fromImage=alpine&tag=3.18 HTTP/1.1\r\nHost: docker\r\n\r\n")
+
+	if !logs.contains(logging.INFO, "injected 'docker image create/pull' command") {
+		t.Errorf("the injection wasn't logged; logged %q", logs.messages(logging.DEBUG, ""))
+	}
+	if logs.contains(logging.WARNING, "unable to inject") {
+		t.Errorf("the injection failed: %q", logs.messages(logging.WARNING, ""))
+	}
+	if logs.contains(logging.DEBUG, "pulling alpine") {
+		t.Error("a message never logged was found")
+	}
+}
+
+func TestLogCaller(t *testing.T) {
+	logs := recordLogs(t, logging.INFO)
+	daemon := &fakeDaemon{reply: func(int, *http.Request) (string, bool) {
+		time.Sleep(100 * time.Millisecond)
+		return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false
+	}}
+	opts := testOptions(daemon)
+	opts.slowPullThreshold = 10 * time.Millisecond
+	proxyRequests(t, opts, "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\n\r\n")
+
+	expected := map[string]string{
+		"injected 'docker image create/pull' command": "handleConnection",
+		"pull alpine platform=linux/arm64":            "handleConnection",
+		// Logged by a timer set up by handleConnection
+		"pull of alpine still running": "handleConnection",
+		"closed docker -> client":      "forwardAll",
+	}
+	for message, caller := range expected {
+		if callers := logs.callers(message); !reflect.DeepEqual(callers, []string{caller}) {
+			t.Errorf("'%s' logged by %q, expected %s", message, callers, caller)
+		}
+	}
+}
+
+// Stands for the logging helpers that -log-caller-depth skips
+func loggingHelper() string {
+	return logCaller(0)
+}
+
+func TestCallerFormatter(t *testing.T) {
+	var line bytes.Buffer
+	record := &logging.Record{Level: logging.NOTICE, Args: []interface{}{"listening on", "/run/docker.sock"}}
+	if err := newCallerFormatter(logFormat).Format(0, record, &line); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(line.String(), "TestCallerForma ▶ NOTIC\033[0m listening on /run/docker.sock") {
+		t.Errorf("unexpected log line %q", line.String())
+	}
+
+	func() {
+		if caller := logCaller(-1); caller != "TestCallerFormatter" {
+			t.Errorf("closure shown as %s, expected the function it is defined in", caller)
+		}
+		if caller := loggingHelper(); caller != "TestCallerFormatter" {
+			t.Errorf("a frame up from the helper is %s, expected its caller", caller)
+		}
+	}()
+}
+
+func TestDebugSample(t *testing.T) {
+	logging.SetLevel(logging.DEBUG, "docker-platformify")
+	defer logging.SetLevel(logging.INFO, "docker-platformify")
+	requests := make([]string, 6)
+	for i := range requests {
+		requests[i] = "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	}
+
+	// Count the forwarded chunks and the injections logged at a sampling rate
+	logged := func(rate uint64) (chunks int, injections int) {
+		logs := recordLogs(t, logging.DEBUG)
+		opts := testOptions(&fakeDaemon{})
+		opts.debugSampleRate = rate
+		proxyRequests(t, opts, requests...)
+		chunks = len(logs.messages(logging.DEBUG, "C -> D")) + len(logs.messages(logging.DEBUG, "D -> C"))
+		return chunks, len(logs.messages(logging.INFO, "injected 'docker image create/pull' command"))
+	}
+
+	all, injections := logged(1)
+	if injections != len(requests) {
+		t.Errorf("logged %d injections without sampling, expected %d", injections, len(requests))
+	}
+	sampled, injections := logged(3)
+	if sampled < all/3 || sampled > all/3+1 {
+		t.Errorf("logged %d of %d forwarded chunks sampling one in 3", sampled, all)
+	}
+	if injections != len(requests) {
+		t.Errorf("logged %d injections while sampling, expected %d", injections, len(requests))
+	}
+}
+
+func TestToggleDebugOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock, proxySock := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "proxy.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	proxy, log := startProxy(t, nil, "-no-banner", dockerSock, proxySock, "linux/arm64", "NOTICE")
+	log.waitFor(t, "listening on")
+
+	if err := proxy.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	log.waitFor(t, "log level set to DEBUG")
+	requestUnix(t, proxySock, "GET", "/_ping")
+	log.waitFor(t, "C -> D GET /_ping")
+
+	// Back to the configured level
+	if err := proxy.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	log.waitFor(t, "log level set to NOTICE")
+	requestUnix(t, proxySock, "GET", "/info")
+	if err := proxy.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	for line := range log.lines {
+		if strings.Contains(line, "DEBUG") || strings.Contains(line, "INFO") {
+			t.Errorf("logged %q after going back to NOTICE", line)
+		}
+	}
+}
+
+func TestLogInstancePrefix(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock := filepath.Join(dir, "docker.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		args   []string
+		prefix string
+	}{
+		{[]string{"-log-socket-path"}, "[" + filepath.Join(dir, "a.sock") + "] "},
+		{[]string{"-log-socket-path", "-log-instance", "builder"}, "[builder] "},
+		{[]string{"-log-instance", "builder"}, "[builder] "},
+	}
+	for i, test := range tests {
+		proxySock := filepath.Join(dir, string(rune('a'+i))+".sock")
+		args := append(append([]string{"-no-banner"}, test.args...), dockerSock, proxySock, "linux/arm64")
+		proxy, log := startProxy(t, nil, args...)
+		log.waitFor(t, "listening on")
+		requestUnix(t, proxySock, "GET", "/_ping")
+		if err := proxy.Process.Signal(syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		lines := 0
+		for line := range log.lines {
+			lines++
+			if !strings.Contains(line, "▶ ") || !strings.Contains(line[strings.Index(line, "▶ "):], test.prefix) {
+				t.Errorf("%q: line %q lacks the prefix %q", test.args, line, test.prefix)
+			}
+		}
+		if lines == 0 {
+			t.Errorf("%q: nothing logged", test.args)
+		}
+	}
+}
@@ -16,35 +16,306 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/op/go-logging"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 var log = logging.MustGetLogger("docker-platformify")
-var format = logging.MustStringFormatter(
-	`%{color}%{shortfunc:-15.15s} ▶ %{level:.5s}%{color:reset} %{message}`,
-)
 
-func forwardAll(srcConn net.Conn, dstConn net.Conn) {
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Log lines start with the name of the function logging them, see callerFormatter
+const logFormat = ` ▶ %{level:.5s}%{color:reset} %{message}`
+
+var format = newCallerFormatter(logFormat)
+
+type options struct {
+	dockerSock string
+	proxySock  string
+	platform   string
+	// Networks of the sockets, either "unix" or "tcp"
+	dockerNetwork string
+	proxyNetwork  string
+	// HTTP proxy to tunnel to a TCP Docker daemon through; nil to connect directly
+	upstreamProxy *url.URL
+	// Reject requests that cannot be injected instead of forwarding them as is
+	failClosed bool
+	// Reject image pulls that are not pinned by digest
+	requireDigest bool
+	// Decide what to do with pulls based on the image; the first matching rule wins
+	rules []*rule
+	// Warn about pulls whose connection is still open after this long; 0 to disable
+	slowPullThreshold time.Duration
+	// Let clients choose the platform of a request with the platformOverrideParam parameter
+	allowPlatformOverride bool
+	// Either "replace", to always inject the platform, or "default", to only inject it into requests without one
+	platformMode string
+	// Name of the query parameter the platform is injected as
+	platformParam string
+	// Platforms to pull images for, in order of preference, if they are available
+	platformPreference []string
+	// How long to remember the platforms images are available for
+	platformCacheTTL time.Duration
+	// Also pull images for this platform in the background; disabled if empty
+	secondaryPlatform string
+	// Fixed query parameters injected along with the platform
+	extraParams queryParamsFlag
+	// Oldest API version each endpoint is rewritten for; requests using older ones are forwarded as is
+	minAPIVersions minAPIVersionsFlag
+	// Registry that pulls of images without one are redirected to; disabled if empty
+	defaultRegistry string
+	// Check at startup whether the daemon can run containers for the platform:
+	// "warn", "refuse" to start, or empty to skip the check
+	checkPlatform string
+	// Only inject the platform into the first image create request of each connection
+	firstPullOnly bool
+	// Also inject the platform into image imports (image create requests with fromSrc)
+	rewriteImports bool
+	// Adopt an already open listening socket instead of creating proxySock; -1 if unset
+	listenFd int
+	// Backlog for the proxy socket; 0 to use the system default
+	listenBacklog int
+	// Umask to create the proxy socket with; -1 to keep the one of the process
+	listenUmask int
+	// Log the removal of a stale proxy socket at DEBUG rather than INFO level
+	quietSocketRemoval bool
+	// Path to listen on instead of an abstract proxySock where those aren't supported
+	abstractFallback string
+	// How long to wait for active connections to finish on shutdown; 0 to exit right away
+	drainTimeout time.Duration
+	// How long connections accepted while paused wait to be served; 0 to reject them right away
+	pauseTimeout time.Duration
+	// Connections served at once, with the others being rejected; 0 for no limit
+	maxConnections int
+	// Close connections that haven't forwarded anything for this long; 0 to disable
+	idleTimeout time.Duration
+	// How often to look for idle connections
+	idleSweepInterval time.Duration
+	// Close connections open for longer than this, even busy ones; 0 to disable
+	maxConnectionLifetime time.Duration
+	// How long to wait for the rest of a partly received request line before forwarding it as is
+	partialLineGrace time.Duration
+	// Inject request lines without an HTTP version as if they were HTTP/1.1 ones
+	assumeHTTPVersion bool
+	// Give up on writes to the Docker daemon that take longer than this; 0 to disable
+	upstreamWriteTimeout time.Duration
+	// How often to check whether the Docker daemon is available; 0 to disable
+	upstreamCheckInterval time.Duration
+	// API endpoints whose requests get the platform injected
+	endpoints []*endpoint
+	// Methods that trigger rewriting of the endpoints besides their own
+	extraMethods []string
+	// Only inject into requests from clients whose executable matches one of these patterns; all if empty
+	clientExes []string
+	// User and group to switch to once the proxy socket is bound
+	user  string
+	group string
+	// Address to serve Prometheus metrics on; disabled if empty
+	metricsAddr string
+	// Only log one in this many forwarded chunks at DEBUG level
+	debugSampleRate uint64
+	// Decompress gzip-encoded bodies of the forwarded data being logged
+	debugGunzip bool
+	// File to write the process ID to; disabled if empty
+	pidFile string
+	// Rewrite the platform fields in image inspect responses
+	rewriteInspectResponse bool
+	// Either "socket" or "stdio"
+	listenMode string
+	// Log a structured startup line instead of printing the banner
+	noBanner bool
+	// Connects to the Docker daemon; nil to dial dockerSock
+	dial func(ctx context.Context) (net.Conn, error)
+	// Exports a trace span per connection and rewritten request; nil if disabled
+	tracer *tracer
+	// Records every rewritten request; nil if disabled
+	accessLog *accessLog
+	// Last rewritten requests served on the metrics address; nil if disabled
+	samples *sampleRing
+	// Kernel socket buffer sizes for both the client and the Docker connections; 0 for the system default
+	rcvBuf int
+	sndBuf int
+	// Set TCP_NODELAY on the TCP client and Docker connections, disabling Nagle's algorithm
+	tcpNoDelay bool
+
+	// Carries the requests the proxy makes to the Docker daemon on its own; built on first use
+	transport     *http.Transport
+	transportOnce sync.Once
+}
+
+// Open a new connection to the Docker daemon
+func (o *options) dialDocker(ctx context.Context) (net.Conn, error) {
+	if o.dial != nil {
+		return o.dial(ctx)
+	}
+	dialer := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setBufferSizes(c, o.rcvBuf, o.sndBuf)
+		},
+	}
+	var conn net.Conn
+	var err error
+	if o.upstreamProxy != nil {
+		conn, err = dialThroughProxy(ctx, &dialer, o.upstreamProxy, o.dockerSock)
+	} else {
+		conn, err = dialer.DialContext(ctx, o.dockerNetwork, o.dockerSock)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := setNoDelay(conn, o.tcpNoDelay); err != nil {
+		log.Warning("unable to set TCP_NODELAY on Docker connection:", err)
+	}
+	return conn, nil
+}
+
+// Get the HTTP transport for the requests the proxy makes to the Docker daemon
+// on its own, e.g. to look up images; it's shared so that their connections are
+// reused rather than left open
+func (o *options) dockerTransport() *http.Transport {
+	o.transportOnce.Do(func() {
+		o.transport = &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return o.dialDocker(ctx)
+			},
+			IdleConnTimeout: 30 * time.Second,
+		}
+	})
+	return o.transport
+}
+
+// Number of forwarded chunks seen, for DEBUG log sampling
+var forwardedChunks uint64
+
+// Log forwarded data at DEBUG level, honoring the sampling rate
+func debugForwarded(opts *options, direction string, data []byte) {
+	if !log.IsEnabledFor(logging.DEBUG) {
+		return
+	}
+	if opts.debugSampleRate > 1 && atomic.AddUint64(&forwardedChunks, 1)%opts.debugSampleRate != 0 {
+		return
+	}
+	if opts.debugGunzip {
+		if decompressed, ok := gunzipBody(data); ok {
+			log.Debug(direction, "(gzip body decompressed)", string(decompressed))
+			return
+		}
+	}
+	log.Debug(direction, string(data))
+}
+
+// Replace the gzip-encoded body following the headers at the beginning of a
+// chunk of forwarded data with as much of it as can be decompressed. The data
+// is only decompressed for logging, what gets forwarded is left untouched.
+func gunzipBody(data []byte) ([]byte, bool) {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, false
+	}
+	gzipped := false
+	for _, line := range bytes.Split(data[:headerEnd], []byte("\r\n"))[1:] {
+		colon := bytes.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		name, value := bytes.TrimSpace(line[:colon]), bytes.TrimSpace(line[colon+1:])
+		switch {
+		case bytes.EqualFold(name, []byte("Content-Encoding")):
+			gzipped = bytes.EqualFold(value, []byte("gzip"))
+		case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+			// Chunk sizes are interleaved with the compressed data
+			if !bytes.EqualFold(value, []byte("identity")) {
+				return nil, false
+			}
+		}
+	}
+	body := data[headerEnd+4:]
+	if !gzipped || len(body) == 0 {
+		return nil, false
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, false
+	}
+	// The rest of the body may come in later chunks, so decompress whatever is there
+	decompressed, _ := ioutil.ReadAll(reader)
+	return append(append([]byte{}, data[:headerEnd+4]...), decompressed...), true
+}
+
+// Forward everything from the docker socket to the client. exchanges holds the
+// requests waiting for their responses, which tell which responses must be
+// rewritten.
+func forwardAll(srcConn net.Conn, dstConn net.Conn, opts *options, info *connInfo, exchanges *exchangeQueue) {
 	buffer := make([]byte, 4096)
+	responses := &messageFramer{
+		response: true,
+		bodiless: func() bool {
+			e := exchanges.peek()
+			return e != nil && e.head
+		},
+		onEnd: func(f *messageFramer) {
+			if f.status >= 100 && f.status < 200 && f.status != 101 {
+				// Interim response, the final one follows
+				return
+			}
+			if e := exchanges.pop(); e != nil && e.done != nil {
+				e.done(f.status)
+			}
+		},
+	}
 	var (
 		readErr      error
 		writeErr     error
 		bytesRead    int
 		bytesWritten int
 	)
+	// Send the response of the proxy to a rejected request if its turn has come
+	replied := func() bool {
+		e := exchanges.peek()
+		if !responses.idle() || e == nil || e.reply == nil {
+			return false
+		}
+		exchanges.pop()
+		reply := e.reply
+		if err := sendAll(&reply, dstConn); err != nil {
+			log.Error("unable to send error response to client:", err)
+		}
+		return true
+	}
 	for {
+		if replied() {
+			// The reply closes the connection
+			break
+		}
+
 		err := srcConn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
-		if err != nil {
+		if isClosed(err) {
+			// The client hung up, and the other direction closed the connection in between reads
+			break
+		} else if err != nil {
 			log.Error("failed to set socket timeout:", err)
 			break
 		}
@@ -54,7 +325,7 @@ func forwardAll(srcConn net.Conn, dstConn net.Conn) {
 		toWrite := bytesRead
 
 		if readErr != nil {
-			if err, ok := readErr.(net.Error); ok && err.Timeout() {
+			if isTimeout(readErr) || isInterrupted(readErr) {
 				if bytesRead == 0 {
 					continue
 				} else {
@@ -63,12 +334,37 @@ func forwardAll(srcConn net.Conn, dstConn net.Conn) {
 			}
 		}
 
-		log.Debug("D -> C", string(buffer))
+		// Before the end of a response reaches the client, which may then act on its outcome right away
+		rewriteFailed := false
+		for consumed := 0; consumed < len(readBuf); {
+			if e := exchanges.peek(); responses.idle() && e != nil && e.inspectPlatform != "" &&
+				bytes.HasPrefix(readBuf[consumed:], []byte("HTTP/1.")) {
+				rewritten, err := rewriteResponseFrom(srcConn, readBuf[consumed:], e.inspectPlatform)
+				if err != nil {
+					readErr = fmt.Errorf("unable to rewrite image inspect response: %v", err)
+					rewriteFailed = true
+					break
+				}
+				// The rewritten response may be larger, and replaces the rest of the data
+				readBuf = append(readBuf[:consumed:consumed], rewritten...)
+				toWrite = len(readBuf)
+			}
+			consumed += responses.consume(readBuf[consumed:])
+		}
+		if rewriteFailed {
+			break
+		}
+		debugForwarded(opts, "D -> C", readBuf)
 
+		// Data read along with an error (e.g. right before EOF) must still be written
 		for toWrite > 0 {
-			bytesWritten, writeErr = dstConn.Write(readBuf)
+			bytesWritten, writeErr = dstConn.Write(readBuf[len(readBuf)-toWrite:])
 			toWrite -= bytesWritten
-			if writeErr != nil {
+			atomic.AddInt64(&stats.bytesForwarded, int64(bytesWritten))
+			info.addBytes(bytesWritten)
+			if isInterrupted(writeErr) {
+				writeErr = nil
+			} else if writeErr != nil {
 				break
 			}
 		}
@@ -77,33 +373,175 @@ func forwardAll(srcConn net.Conn, dstConn net.Conn) {
 		}
 	}
 
-	if readErr != nil && readErr != io.EOF {
-		if !strings.HasSuffix(readErr.Error(), "use of closed network connection") {
+	if readErr == io.EOF && writeErr == nil && replied() {
+		// The daemon may hang up after answering the requests before the rejected one
+		readErr = nil
+	}
+	if readErr == io.EOF && (responses.inMessage() || exchanges.len() > 0) {
+		log.Warning("Docker daemon closed the connection before responding to all the requests of the client")
+	} else if readErr == io.EOF {
+		// e.g. idle kept-alive connections, or the end of a stream after an upgrade
+		log.Info("Docker daemon closed the connection")
+	} else if readErr != nil {
+		if !isClosed(readErr) {
 			log.Error("error while reading from docker socket:", readErr)
+			stats.addError()
 		}
 	}
 	if writeErr != nil {
 		log.Error("error while writing to client socket:", writeErr)
+		stats.addError()
 	}
-	if err := dstConn.Close(); err != nil {
+	if closed, err := info.closer.close(); err != nil {
 		log.Error("unable to close client connection:", err)
-	} else {
+	} else if closed {
 		log.Info("closed docker -> client")
 	}
 }
 
-// Inject the platform field into the query parameters without actually parsing
-// the full HTTP request
-func injectPlatform(buffer []byte, platform string) (injected []byte, err error) {
-	parts := bytes.SplitN(buffer, []byte(" "), 3)
-	if len(parts) < 3 {
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// Locate the request target in an HTTP request line, tolerating runs of spaces
+// and tabs between the parts. The line terminator, if any, is left untouched.
+func parseRequestLine(line []byte) (targetStart int, targetEnd int, err error) {
+	methodEnd := bytes.IndexAny(line, " \t")
+	if methodEnd <= 0 {
 		err = errors.New("invalid HTTP request")
 		return
 	}
-	method := parts[0]
-	rawUrl := parts[1]
-	version := parts[2]
 
+	targetStart = methodEnd
+	for targetStart < len(line) && isBlank(line[targetStart]) {
+		targetStart++
+	}
+	targetEnd = targetStart
+	for targetEnd < len(line) && !isBlank(line[targetEnd]) && line[targetEnd] != '\r' {
+		targetEnd++
+	}
+
+	versionStart := targetEnd
+	for versionStart < len(line) && isBlank(line[versionStart]) {
+		versionStart++
+	}
+	if targetEnd == targetStart || versionStart == targetEnd || versionStart == len(line) || line[versionStart] == '\r' {
+		err = errors.New("invalid HTTP request")
+	}
+	return
+}
+
+// Add "HTTP/1.1" to a request line that lacks an HTTP version, e.g.
+// "POST /images/create", keeping the line terminator, if any. ok is false if
+// the line has a version already or can't be fixed that way.
+func withHTTPVersion(line []byte) (fixed []byte, ok bool) {
+	if _, _, err := parseRequestLine(line); err == nil {
+		return line, false
+	}
+	requestLine := bytes.TrimRight(line, "\r")
+	terminator := line[len(requestLine):]
+	requestLine = bytes.TrimRight(requestLine, " \t")
+
+	fixed = make([]byte, 0, len(requestLine)+len(" HTTP/1.1")+len(terminator))
+	fixed = append(fixed, requestLine...)
+	fixed = append(fixed, " HTTP/1.1"...)
+	fixed = append(fixed, terminator...)
+	if _, _, err := parseRequestLine(fixed); err != nil {
+		return line, false
+	}
+	return fixed, true
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// Check whether the platform can be injected by simply appending it to the raw
+// URL: it must not contain anything url.Parse would need to handle, nor an
+// existing platform parameter that has to be replaced. Only the query is
+// looked at, the path may well contain "platform", e.g. in an image name.
+func canAppendPlatform(rawUrl []byte, name string) bool {
+	queryStart := -1
+	for i := 0; i < len(rawUrl); i++ {
+		switch c := rawUrl[i]; {
+		case c < 0x20 || c == 0x7f || c == '#' || c == ';':
+			return false
+		case c == '%':
+			if i+2 >= len(rawUrl) || !isHex(rawUrl[i+1]) || !isHex(rawUrl[i+2]) {
+				return false
+			}
+		case c == '?' && queryStart < 0:
+			queryStart = i
+		}
+	}
+	if queryStart < 0 {
+		return true
+	}
+
+	query := rawUrl[queryStart+1:]
+	for len(query) > 0 {
+		var param []byte
+		if i := bytes.IndexByte(query, '&'); i >= 0 {
+			param, query = query[:i], query[i+1:]
+		} else {
+			param, query = query, nil
+		}
+		if i := bytes.IndexByte(param, '='); i >= 0 {
+			param = param[:i]
+		}
+		// Escaped keys may decode to the parameter name
+		if bytes.Equal(param, []byte(name)) || bytes.IndexByte(param, '%') >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Inject the platform field into the query parameters without actually parsing
+// the full HTTP request. Only the request target is replaced: the method, the
+// version and the line terminator (including the "\r" of a CRLF) are kept byte
+// for byte so that the request framing isn't affected. The name of the query
+// parameter is normally "platform".
+func injectPlatform(buffer []byte, name string, platform string) (injected []byte, err error) {
+	urlStart, urlEnd, err := parseRequestLine(buffer)
+	if err != nil {
+		return
+	}
+	if canAppendPlatform(buffer[urlStart:urlEnd], name) {
+		return appendPlatform(buffer, urlEnd, name, platform), nil
+	}
+	return replacePlatform(buffer, urlStart, urlEnd, name, platform)
+}
+
+// Fast path of injectPlatform: append the parameter to the request target
+// ending at urlEnd in a single allocation. Only valid when canAppendPlatform
+// agrees.
+func appendPlatform(buffer []byte, urlEnd int, name string, platform string) []byte {
+	rawUrl := buffer[:urlEnd]
+	separator := byte('&')
+	if bytes.IndexByte(rawUrl, '?') < 0 {
+		separator = '?'
+	} else if rawUrl[len(rawUrl)-1] == '?' || rawUrl[len(rawUrl)-1] == '&' {
+		separator = 0
+	}
+
+	param := url.QueryEscape(platform)
+	injected := make([]byte, 0, len(buffer)+len(name)+len("&=")+len(param))
+	injected = append(injected, buffer[:urlEnd]...)
+	if separator != 0 {
+		injected = append(injected, separator)
+	}
+	injected = append(injected, name...)
+	injected = append(injected, '=')
+	injected = append(injected, param...)
+	injected = append(injected, buffer[urlEnd:]...)
+	return injected
+}
+
+// Slow path of injectPlatform: parse the request target between urlStart and
+// urlEnd and encode it again with the parameter set
+func replacePlatform(buffer []byte, urlStart int, urlEnd int, name string, platform string) (injected []byte, err error) {
+	rawUrl := buffer[urlStart:urlEnd]
 	u, err := url.Parse(string(rawUrl))
 	if err != nil {
 		return
@@ -114,205 +552,1328 @@ func injectPlatform(buffer []byte, platform string) (injected []byte, err error)
 		return
 	}
 
-	if _, ok := query["platform"]; ok {
-		query.Del("platform")
+	// Drop all the existing values, the client or a chained proxy may have sent
+	// more than one: exactly one platform parameter must be left
+	query.Set(name, platform)
+	u.RawQuery = query.Encode()
+
+	injUrl := u.String()
+
+	injected = make([]byte, 0, len(buffer)-len(rawUrl)+len(injUrl))
+	injected = append(injected, buffer[:urlStart]...)
+	injected = append(injected, injUrl...)
+	injected = append(injected, buffer[urlEnd:]...)
+	return injected, nil
+}
+
+// Query parameter that clients which can't set the platform themselves, e.g.
+// through a wrapper script, may use to choose the platform to inject
+const platformOverrideParam = "__platformify"
+
+// Remove the platform override parameter from a request line, returning the
+// requested platform along with the stripped request line; the platform is
+// empty if the parameter isn't there or has no value
+func takePlatformOverride(buffer []byte) (platform string, stripped []byte, err error) {
+	if !bytes.Contains(buffer, []byte(platformOverrideParam)) {
+		return "", buffer, nil
+	}
+	urlStart, urlEnd, err := parseRequestLine(buffer)
+	if err != nil {
+		return
 	}
 
-	query.Add("platform", platform)
+	u, err := url.Parse(string(buffer[urlStart:urlEnd]))
+	if err != nil {
+		return
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return
+	}
+	if _, ok := query[platformOverrideParam]; !ok {
+		return "", buffer, nil
+	}
+	// An empty override is stripped too, the daemon doesn't know about it
+	platform = normalizePlatform(query.Get(platformOverrideParam))
+	if os, arch, _ := splitPlatform(platform); platform != "" && (os == "" || arch == "") {
+		return "", nil, fmt.Errorf("invalid platform '%s' in %s parameter", platform, platformOverrideParam)
+	}
+	query.Del(platformOverrideParam)
 	u.RawQuery = query.Encode()
 
-	injUrl := []byte(u.String())
+	strippedUrl := u.String()
+	stripped = make([]byte, 0, len(buffer)-(urlEnd-urlStart)+len(strippedUrl))
+	stripped = append(stripped, buffer[:urlStart]...)
+	stripped = append(stripped, strippedUrl...)
+	stripped = append(stripped, buffer[urlEnd:]...)
+	return platform, stripped, nil
+}
+
+// Prepend the registry to the image pulled by an image create request line if
+// it doesn't name one, which would make Docker pull it from Docker Hub
+func setDefaultRegistry(buffer []byte, registry string) (rewritten []byte, err error) {
+	urlStart, urlEnd, err := parseRequestLine(buffer)
+	if err != nil {
+		return
+	}
+
+	u, err := url.Parse(string(buffer[urlStart:urlEnd]))
+	if err != nil {
+		return
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return
+	}
+	image := query.Get("fromImage")
+	if image == "" || hasRegistry(image) {
+		return buffer, nil
+	}
+	if !strings.Contains(image, "/") {
+		// Official images live under library/
+		image = "library/" + image
+	}
+	query.Set("fromImage", registry+"/"+image)
+	u.RawQuery = query.Encode()
+
+	rewrittenUrl := u.String()
+	rewritten = make([]byte, 0, len(buffer)-(urlEnd-urlStart)+len(rewrittenUrl))
+	rewritten = append(rewritten, buffer[:urlStart]...)
+	rewritten = append(rewritten, rewrittenUrl...)
+	rewritten = append(rewritten, buffer[urlEnd:]...)
+	return rewritten, nil
+}
+
+// Parse the query parameters of an HTTP request line
+func requestQuery(requestLine []byte) (query url.Values, err error) {
+	urlStart, urlEnd, err := parseRequestLine(requestLine)
+	if err != nil {
+		return
+	}
+
+	u, err := url.Parse(string(requestLine[urlStart:urlEnd]))
+	if err != nil {
+		return
+	}
+
+	return url.ParseQuery(u.RawQuery)
+}
+
+// Reference of the image pulled by an image create request, e.g. "alpine:3.19"
+func pulledImage(query url.Values) string {
+	image := query.Get("fromImage")
+	if tag := query.Get("tag"); tag != "" {
+		// Digest pulls carry the digest in the tag parameter
+		if strings.HasPrefix(tag, "sha256:") {
+			image += "@" + tag
+		} else {
+			image += ":" + tag
+		}
+	}
+	return image
+}
+
+// Check whether an image create request line pulls an image pinned by digest;
+// imports, which don't pull anything, are considered pinned
+func pinnedByDigest(requestLine []byte) bool {
+	query, err := requestQuery(requestLine)
+	if err != nil {
+		return false
+	}
+	if query.Get("fromImage") == "" {
+		return query.Get("fromSrc") != ""
+	}
+	return strings.Contains(pulledImage(query), "@sha256:")
+}
+
+// Find the rule matching the image pulled by an image create request line, or
+// nil if there's none
+func requestRule(rules []*rule, requestLine []byte) *rule {
+	if len(rules) == 0 {
+		return nil
+	}
+	query, err := requestQuery(requestLine)
+	if err != nil || query.Get("fromImage") == "" {
+		return nil
+	}
+	return matchRule(rules, pulledImage(query))
+}
 
-	return bytes.Join([][]byte{method, injUrl, version}, []byte(" ")), nil
+// Check whether an image create request line imports an image from a tarball
+// rather than pulling it
+func isImport(requestLine []byte) bool {
+	query, err := requestQuery(requestLine)
+	return err == nil && query.Get("fromSrc") != ""
+}
+
+// Get the named platform parameter of a request line, or an empty string if it
+// doesn't carry one
+func requestedPlatform(requestLine []byte, name string) string {
+	query, err := requestQuery(requestLine)
+	if err != nil {
+		return ""
+	}
+	return query.Get(name)
+}
+
+// Check whether a request line already carries the named platform parameter
+func hasPlatform(requestLine []byte, name string) bool {
+	return requestedPlatform(requestLine, name) != ""
 }
 
 func sendAll(buffer *[]byte, conn net.Conn) (err error) {
-	toWrite := len(*buffer)
-	for toWrite > 0 {
-		bytesWritten, err := conn.Write(*buffer)
-		toWrite -= bytesWritten
-		if err != nil {
+	toWrite := *buffer
+	for len(toWrite) > 0 {
+		bytesWritten, err := conn.Write(toWrite)
+		toWrite = toWrite[bytesWritten:]
+		if err != nil && !isInterrupted(err) {
 			return err
 		}
 	}
 	return nil
 }
 
-func handleConnection(conn net.Conn, dockerSock string, platform string) {
-	buffer := make([]byte, 4096)
-	dockerConn, err := net.Dial("unix", dockerSock)
+// Reply to the client with a synthetic HTTP error, shaped like the ones returned
+// by the Docker daemon so that clients can display them; the connection is
+// expected to be closed right after
+func writeErrorResponse(conn net.Conn, status int, message string) error {
+	response := errorResponse(status, message)
+	return sendAll(&response, conn)
+}
+
+// Build the synthetic HTTP error sent by writeErrorResponse
+func errorResponse(status int, message string) []byte {
+	// Marshaling a string can't fail
+	body, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{message})
+	body = append(body, '\n')
+	header := fmt.Sprintf(
+		"HTTP/1.1 %d %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status), len(body),
+	)
+	return append([]byte(header), body...)
+}
+
+// How often to warn that the connection limit is being hit
+const saturationWarningInterval = time.Minute
+
+// Serve a connection accepted on the proxied socket. The user of the client is
+// looked up here rather than in the accept loop, since that may involve a slow
+// NSS lookup, e.g. through LDAP.
+func serveClient(conn net.Conn, opts *options) {
+	if user, err := peerUser(conn); err == nil {
+		log.Info("new connection to proxy socket from", user)
+	} else {
+		log.Info("new connection to proxy socket")
+	}
+	handleConnection(conn, opts)
+}
+
+// Turn away a connection, e.g. one over the connection limit, with a 503 error
+func rejectConnection(conn net.Conn, message string) {
+	if err := writeErrorResponse(conn, http.StatusServiceUnavailable, message); err != nil {
+		log.Error("unable to send error response to client:", err)
+	}
+	if err := conn.Close(); err != nil {
+		log.Error("unable to close client connection:", err)
+	}
+}
+
+// Check whether the executable of the client matches one of the patterns
+func clientExeMatches(conn net.Conn, patterns []string) bool {
+	exe, err := peerExecutable(conn)
+	if err != nil {
+		log.Warning("unable to identify the client executable, forwarding the connection as is:", err)
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, exe); matched {
+			return true
+		}
+	}
+	log.Infof("client executable %s doesn't match, forwarding the connection as is", exe)
+	return false
+}
+
+// Sent by HTTP/2 clients at the beginning of the connection
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+func handleConnection(conn net.Conn, opts *options) {
+	atomic.AddInt64(&stats.activeConnections, 1)
+	atomic.AddInt64(&stats.totalConnections, 1)
+	defer atomic.AddInt64(&stats.activeConnections, -1)
+	info := activeConns.add(conn)
+	defer activeConns.remove(info)
+
+	connSpan := opts.tracer.startSpan("connection", nil, time.Now())
+	connSpan.setAttribute("docker.platform", opts.platform)
+	defer connSpan.finish()
+
+	dockerConn, err := opts.dialDocker(context.Background())
 	if err != nil {
 		log.Error("unable to connect to Docker socket:", err)
+		stats.addError()
+		if err := writeErrorResponse(conn, http.StatusBadGateway, "docker-platformify: unable to connect to the Docker daemon"); err != nil {
+			log.Error("unable to send error response to client:", err)
+		}
+		if _, err := info.closer.close(); err != nil {
+			log.Error("unable to close client connection:", err)
+		}
 		return
 	}
+	dockerCloser := &connCloser{conn: dockerConn}
+	if opts.maxConnectionLifetime > 0 {
+		lifetime := time.AfterFunc(opts.maxConnectionLifetime, func() {
+			if closed, _ := info.closer.close(); closed {
+				log.Infof("closed connection %d from %s, open for longer than %s", info.id, info.peer, opts.maxConnectionLifetime)
+			}
+		})
+		defer lifetime.Stop()
+	}
 
 	var (
 		readErr  error
 		writeErr error
 	)
-	dirtyBytes := 0
-	bytesRead := 0
+	rejected := false
+	// Whether the protocol spoken by the client has been checked, and if it must be forwarded without injecting
+	protocolChecked := false
+	passThrough := len(opts.clientExes) > 0 && !clientExeMatches(conn, opts.clientExes)
+	// Client data is buffered until a whole request line can be inspected
+	reader := bufio.NewReaderSize(conn, 4096)
+	// Number of buffered bytes needed before processing them
+	needed := 1
+	// When the data at the beginning of the buffer was received, or, for data
+	// left over after the previous request, when the proxy got to it
+	var receivedAt time.Time
+	// When the proxy started waiting for the rest of a partly received request line
+	var waitingSince time.Time
+	waitForRestOfLine := func() bool {
+		if waitingSince.IsZero() {
+			waitingSince = time.Now()
+		}
+		return time.Since(waitingSince) < opts.partialLineGrace
+	}
+	// Fire the warnings about slow pulls
+	var slowPullTimers []*time.Timer
+	defer func() {
+		for _, timer := range slowPullTimers {
+			timer.Stop()
+		}
+	}()
 
-	go forwardAll(dockerConn, conn)
+	// Number of image create requests seen on the connection
+	pulls := 0
+	// Requests waiting for their responses
+	exchanges := &exchangeQueue{}
+	// Reject the request being looked at, and everything after it, once the responses to the previous ones have been
+	// forwarded
+	reject := func(status int, message string) {
+		exchanges.push(&exchange{reply: errorResponse(status, message)})
+		rejected = true
+	}
+	// Called once the response to the request being forwarded has been received from the daemon
+	var afterResponse []func(status int)
+	// Platform to report in the response to the image inspect request being forwarded, if any
+	var inspectAs string
+	// Tells where each request ends, so that only request lines are looked at, never e.g. the body of a build
+	requests := &messageFramer{
+		onStart: func(f *messageFramer) {
+			e := &exchange{head: bytes.HasPrefix(f.startLine, []byte("HEAD "))}
+			if hooks := afterResponse; len(hooks) > 0 {
+				e.done = func(status int) {
+					for _, hook := range hooks {
+						hook(status)
+					}
+				}
+			}
+			afterResponse = nil
+			e.inspectPlatform, inspectAs = inspectAs, ""
+			exchanges.push(e)
+		},
+	}
 
-	for {
+	forwardDone := make(chan struct{})
+	go func() {
+		forwardAll(dockerConn, conn, opts, info, exchanges)
+		close(forwardDone)
+	}()
 
-		err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
-		if err != nil {
-			log.Error("failed to set socket timeout:", err)
-			break
-		}
-		offsetBuf := buffer[dirtyBytes:]
-		bytesRead, readErr = conn.Read(offsetBuf)
-		bytesRead += dirtyBytes
-		dirtyBytes = 0
+	for {
+		if reader.Buffered() < needed {
+			err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+			if isClosed(err) {
+				// The daemon hung up, and the other direction closed the connection in between reads
+				readErr = nil
+				break
+			} else if err != nil {
+				log.Error("failed to set socket timeout:", err)
+				break
+			}
+			wasEmpty := reader.Buffered() == 0
+			_, readErr = reader.Peek(needed)
+			if wasEmpty && reader.Buffered() > 0 {
+				receivedAt = time.Now()
+			}
 
-		if readErr != nil {
-			if err, ok := readErr.(net.Error); ok && err.Timeout() {
-				if bytesRead == 0 {
+			if isTimeout(readErr) || isInterrupted(readErr) {
+				if reader.Buffered() == 0 {
 					continue
 				} else {
 					readErr = nil
 				}
 			}
 		}
+		needed = 1
 
-		readBuf := buffer[:bytesRead]
+		// Peeking at what has already been buffered never reads from the client; the data must be sent before
+		// discarding it, since discarding allows the reader to reuse its buffer
+		peeked, _ := reader.Peek(reader.Buffered())
+		readBuf := peeked
+		consumed := len(readBuf)
+		injected := false
+
+		if !protocolChecked {
+			n := len(readBuf)
+			if n > len(http2Preface) {
+				n = len(http2Preface)
+			}
+			if bytes.Equal(readBuf[:n], http2Preface[:n]) {
+				if n < len(http2Preface) && readErr == nil {
+					// Wait for the rest of the preface
+					needed = len(readBuf) + 1
+					continue
+				}
+				if n == len(http2Preface) {
+					log.Warning("client is speaking HTTP/2, which is not supported for injection; forwarding the connection as is")
+					passThrough = true
+				}
+			}
+			protocolChecked = true
+		}
 
-		if bytes.Contains(readBuf, []byte("POST")) && bytes.Contains(readBuf, []byte("/images/create")) {
-			index := bytes.Index(buffer, []byte("POST"))
-
-			if index > 0 {
-				// Copy all data before "POST" into a new readBuf to be sent; move the rest to the beginning of buffer
-				// so we can process it in the next run
-				dirtyBytes = bytesRead - index
-				readBuf = make([]byte, index)
-				copy(readBuf, buffer[:index])
-				for i := 0; i < dirtyBytes; i++ {
-					buffer[i] = buffer[index+i]
+		// Whether a request starts at the beginning of the buffer
+		requestStart := requests.idle() && len(readBuf) > 0 && readBuf[0] != '\r' && readBuf[0] != '\n'
+		if requestStart {
+			// Taken once the request line has been forwarded, which may be in a later run
+			inspectAs = ""
+			if opts.rewriteInspectResponse && !passThrough && imageInspect.matches(readBuf, imageInspect.method) {
+				if lineEnd := bytes.IndexByte(readBuf, '\n'); lineEnd >= 0 {
+					inspectAs = inspectPlatform(opts, readBuf[:lineEnd], registryAuth(readBuf))
 				}
-			} else if index == 0 {
-				// Find the end of the line and inject it; then send it and copy the rest of the buffer to the beginning
-				// so we can send it in the next run
-				index = bytes.Index(readBuf, []byte("\n"))
-				if index < 0 {
-					log.Warning("tried to inject request, but it's either invalid or too long")
+			}
+		}
+		// Data forwarded as is must not go past the end of the current request, so that the next one is looked at
+		forwardRequest := func() {
+			consumed = requests.consume(peeked)
+			readBuf = peeked[:consumed]
+		}
+
+		if passThrough {
+			// Everything is forwarded untouched
+		} else if ep := requestEndpoint(readBuf, opts.endpoints, opts.extraMethods); !requestStart || ep == nil {
+			// The request line may have only partly been received
+			if requestStart && readErr == nil && len(readBuf) < reader.Size() && bytes.IndexByte(readBuf, '\n') < 0 &&
+				mayStartRequest(readBuf, opts.endpoints, opts.extraMethods) && waitForRestOfLine() {
+				needed = len(readBuf) + 1
+				continue
+			}
+			forwardRequest()
+		} else {
+			lineEnd := bytes.IndexByte(readBuf, '\n')
+			partial := lineEnd < 0 && readErr == nil && len(readBuf) < reader.Size()
+			if partial && waitForRestOfLine() {
+				needed = len(readBuf) + 1
+				continue
+			}
+
+			var matchedRule *rule
+			if lineEnd >= 0 && ep == imagesCreate {
+				matchedRule = requestRule(opts.rules, readBuf[:lineEnd])
+				pulls++
+			}
+
+			// Inject the request line, the rest of the data is sent in the next run
+			var injectErr error
+			if partial {
+				injectErr = fmt.Errorf("request line still incomplete after %s", opts.partialLineGrace)
+			} else if lineEnd < 0 {
+				injectErr = errors.New("request line is either invalid or too long")
+			} else if opts.requireDigest && ep == imagesCreate && !pinnedByDigest(readBuf[:lineEnd]) {
+				log.Warningf("rejecting pull not pinned by digest: '%s'", readBuf[:lineEnd])
+				reject(http.StatusForbidden, "docker-platformify: only images pinned by digest (name@sha256:...) may be pulled")
+			} else if matchedRule != nil && matchedRule.action == "deny" {
+				log.Warningf("rejecting pull denied by rule on line %d: '%s'", matchedRule.line, readBuf[:lineEnd])
+				reject(http.StatusForbidden, "docker-platformify: pulling this image is not allowed")
+			} else if opts.firstPullOnly && ep == imagesCreate && pulls > 1 {
+				log.Info("not the first pull on this connection, forwarding it as is")
+				readBuf = readBuf[:lineEnd]
+				consumed = lineEnd
+			} else if !opts.rewriteImports && ep == imagesCreate && isImport(readBuf[:lineEnd]) {
+				log.Info("image import doesn't pull anything, forwarding it as is")
+				readBuf = readBuf[:lineEnd]
+				consumed = lineEnd
+			} else if version, minimum, old := opts.minAPIVersions.tooOld(ep, readBuf[:lineEnd]); old {
+				log.Infof("'%s' command uses API %s, older than %s, forwarding it as is", ep.name, version, minimum)
+				readBuf = readBuf[:lineEnd]
+				consumed = lineEnd
+			} else if opts.platformMode == "default" && hasPlatform(readBuf[:lineEnd], opts.platformParam) {
+				// The platform chosen by the client wins over the configured one
+				log.Infof("'%s' command already has a platform, forwarding it as is", ep.name)
+				readBuf = readBuf[:lineEnd]
+				consumed = lineEnd
+			} else {
+				toInjectBuf := readBuf[:lineEnd]
+				if opts.assumeHTTPVersion {
+					if fixed, ok := withHTTPVersion(toInjectBuf); ok {
+						log.Infof("request line '%s' has no HTTP version, assuming HTTP/1.1", bytes.TrimRight(toInjectBuf, "\r"))
+						toInjectBuf = fixed
+					}
+				}
+				platform := opts.platform
+				// A platform picked for this very request wins over the preferences
+				picked := false
+				if matchedRule != nil && matchedRule.action == "platform" {
+					platform = matchedRule.platform
+					picked = true
+				}
+				var injectedBuf []byte
+				var err error
+				if opts.allowPlatformOverride {
+					var override string
+					if override, injectedBuf, err = takePlatformOverride(toInjectBuf); override != "" {
+						platform = override
+						picked = true
+					}
 				} else {
-					toInjectBuf := readBuf[:index]
-					injectedBuf, err := injectPlatform(toInjectBuf, platform)
-					if err == nil {
-						log.Info("injected 'docker image create/pull' command")
-
-						readBuf = injectedBuf
-						dirtyBytes = bytesRead - index
-						for i := 0; i < dirtyBytes; i++ {
-							buffer[i] = buffer[index+i]
+					injectedBuf = toInjectBuf
+				}
+				// The request line as sent by the client, when the image is pulled from the default registry instead
+				var mirroredLine []byte
+				if err == nil && opts.defaultRegistry != "" && ep == imagesCreate {
+					requestLine := injectedBuf
+					if injectedBuf, err = setDefaultRegistry(injectedBuf, opts.defaultRegistry); err == nil &&
+						!bytes.Equal(injectedBuf, requestLine) {
+						// The client's data may be overwritten once forwarded
+						mirroredLine = append([]byte{}, requestLine...)
+					}
+				}
+				if err == nil && !picked && len(opts.platformPreference) > 0 && ep == imagesCreate {
+					platform = preferredPlatform(opts, injectedBuf, registryAuth(readBuf))
+				}
+				var value string
+				if err == nil {
+					value, err = ep.platformValue(platform)
+				}
+				if requested := requestedPlatform(injectedBuf, opts.platformParam); err == nil && requested != "" &&
+					requested != value && normalizePlatform(requested) != platform {
+					// Let users know why their explicit choice has no effect
+					log.Noticef("'%s' command asked for platform %s, replacing it with %s", ep.name, requested, value)
+				}
+				if err == nil {
+					injectedBuf, err = injectPlatform(injectedBuf, opts.platformParam, value)
+				}
+				if err == nil && len(opts.extraParams) > 0 {
+					injectedBuf, err = injectParams(injectedBuf, opts.extraParams)
+				}
+				if err == nil {
+					log.Infof("injected '%s' command", ep.name)
+					atomic.AddInt64(&stats.injections, 1)
+
+					injectSpan := opts.tracer.startSpan("inject", connSpan, receivedAt)
+					injectSpan.setAttribute("docker.endpoint", ep.name)
+					injectSpan.setAttribute("docker.platform", platform)
+					if ep == imagesCreate {
+						if query, err := requestQuery(injectedBuf); err == nil && query.Get("fromImage") != "" {
+							image := pulledImage(query)
+							log.Infof("pull %s platform=%s", image, query.Get(opts.platformParam))
+							injectSpan.setAttribute("docker.image", image)
+							if opts.secondaryPlatform != "" && opts.secondaryPlatform != platform {
+								requestLine, auth := injectedBuf, registryAuth(readBuf)
+								// Racing the client's pull could leave its tag pointing to the secondary platform
+								afterResponse = append(afterResponse, func(status int) {
+									if status == http.StatusOK {
+										go pullSecondary(opts, requestLine, auth)
+									}
+								})
+							}
+							if mirroredLine != nil {
+								requestLine, rewrittenLine := mirroredLine, injectedBuf
+								// Before the client learns that the pull is over, so that it can use the image right away
+								afterResponse = append(afterResponse, func(status int) {
+									if status == http.StatusOK {
+										tagMirroredImage(opts, requestLine, rewrittenLine)
+									}
+								})
+							}
+							if opts.slowPullThreshold > 0 {
+								timer := time.AfterFunc(opts.slowPullThreshold, func() {
+									log.Warningf("pull of %s still running after %s, the registry may be stuck", image, opts.slowPullThreshold)
+								})
+								slowPullTimers = append(slowPullTimers, timer)
+								// The pull is over once its progress stream ends, even if the connection is kept alive
+								afterResponse = append(afterResponse, func(int) { timer.Stop() })
+							}
 						}
-					} else {
-						log.Warning("unable to inject HTTP request, sending as is: '%s'; %s\n", toInjectBuf, err)
-						err = nil
 					}
+					injectSpan.finish()
+					opts.accessLog.record(info.peer, injectedBuf, platform)
+					opts.samples.add(info.peer, injectedBuf, platform)
+
+					if inspectAs != "" {
+						// The daemon reports on the platform it was asked about
+						inspectAs = platform
+					}
+					readBuf = injectedBuf
+					consumed = lineEnd
+					injected = true
+				} else {
+					injectErr = fmt.Errorf("'%s': %v", toInjectBuf, err)
 				}
 			}
+
+			if injectErr != nil {
+				stats.addError()
+				if opts.failClosed {
+					log.Warningf("unable to inject HTTP request, rejecting it: %s", injectErr)
+					reject(http.StatusInternalServerError, "docker-platformify: unable to inject platform into request")
+				} else {
+					log.Warningf("unable to inject HTTP request, sending as is: %s", injectErr)
+					forwardRequest()
+				}
+			} else {
+				// Only the request line has been handled, the rest of the request follows in the next runs
+				requests.consume(peeked[:consumed])
+			}
+		}
+		waitingSince = time.Time{}
+		if rejected {
+			break
 		}
-		log.Debug("C -> D", string(readBuf))
+		debugForwarded(opts, "C -> D", readBuf)
 
+		if opts.upstreamWriteTimeout > 0 {
+			if err := dockerConn.SetWriteDeadline(time.Now().Add(opts.upstreamWriteTimeout)); err != nil {
+				log.Error("failed to set socket timeout:", err)
+				break
+			}
+		}
 		writeErr = sendAll(&readBuf, dockerConn)
+		if writeErr == nil {
+			atomic.AddInt64(&stats.bytesForwarded, int64(len(readBuf)))
+			info.addBytes(len(readBuf))
+			if injected {
+				injectionLatency.observe(time.Since(receivedAt).Seconds())
+			}
+		}
+		_, _ = reader.Discard(consumed)
+		if reader.Buffered() > 0 {
+			// A pipelined request is only picked up now, don't count the time
+			// spent on the previous one towards its latency
+			receivedAt = time.Now()
+		}
 
-		if readErr != nil || writeErr != nil {
+		// Flush any leftovers before giving up on a failed read
+		if writeErr != nil || (readErr != nil && reader.Buffered() == 0) {
 			break
 		}
 	}
 
-	if readErr != nil && readErr != io.EOF {
+	// The client connection is closed from the other direction when the daemon hangs up, which has already been logged
+	if readErr != nil && readErr != io.EOF && !isClosed(readErr) {
 		log.Error("error while reading from client socket:", readErr)
+		stats.addError()
 	}
-	if writeErr != nil {
+	if isTimeout(writeErr) {
+		log.Errorf("timed out after %s writing to docker socket, the daemon stopped reading; closing the connection",
+			opts.upstreamWriteTimeout)
+		stats.addError()
+	} else if writeErr != nil {
 		log.Error("error while writing to docker socket:", writeErr)
+		stats.addError()
 	}
 
-	if err := dockerConn.Close(); err != nil {
+	if rejected {
+		// The daemon is still to answer the requests before the rejected one
+		<-forwardDone
+	}
+	if closed, err := dockerCloser.close(); err != nil {
 		log.Error("unable to close docker connection:", err)
-	} else {
+	} else if closed {
 		log.Info("closed client -> docker")
 	}
+
+	// The connection is over once the docker -> client direction notices
+	<-forwardDone
 }
 
-func ensureSocketDoesNotExist(proxySock string) error {
+func ensureSocketDoesNotExist(proxySock string, quiet bool) error {
 	// Delete socket if it exists
 	if stat, err := os.Stat(proxySock); err != nil && !os.IsNotExist(err) {
 		// Stat failed, "proxySock" appears to exist in the filesystem
-		return errors.New(fmt.Sprintf("unable to stat proxy socket: %v", err))
+		return fmt.Errorf("unable to stat proxy socket: %w", err)
 	} else if stat != nil {
 		// Stat didn't fail, "proxySock" exists
 		if sysStat, ok := stat.Sys().(*syscall.Stat_t); ok {
 			if (sysStat.Mode & syscall.S_IFMT) == syscall.S_IFSOCK {
 				// "proxySock" is effectively a socket, we'll remove it
 				if err := os.Remove(proxySock); err != nil {
-					return errors.New(fmt.Sprintf("proxy socket exists and it could not be removed: %v", err))
+					return fmt.Errorf("proxy socket exists and it could not be removed: %w", err)
 				} else {
-					log.Info("removed old proxy socket")
+					if quiet {
+						log.Debug("removed old proxy socket")
+					} else {
+						log.Info("removed old proxy socket")
+					}
 					return nil
 				}
 			} else {
-				return errors.New(fmt.Sprintf("proxy socket '%s' exists and is not a socket", proxySock))
+				return &exitError{exitSocketInUse, fmt.Errorf("proxy socket '%s' exists and is not a socket", proxySock)}
 			}
 		} else {
 			// proxySock exists but we weren't able to check what it is.
 			// We're not going to delete it since it might be some important document
-			return errors.New(fmt.Sprintf("proxy socket '%s' exists in filesystem", proxySock))
+			return &exitError{exitSocketInUse, fmt.Errorf("proxy socket '%s' exists in filesystem", proxySock)}
 		}
 	}
 	return nil
 }
 
+// Log a structured line in place of the banner, for automation to parse
+func logStartup(opts *options, listen string) {
+	log.Noticef("startup listen=%q upstream=%q platform=%q version=%q",
+		listen, opts.dockerNetwork+"://"+opts.dockerSock, opts.platform, version)
+}
+
+// Bind the proxy socket and serve it until SIGINT/SIGTERM is received. Once the
+// socket is bound, it's cleaned up on every return path.
+func run(opts *options) error {
+	defer opts.tracer.shutdown()
+	defer opts.accessLog.close()
+
+	if opts.listenMode == "stdio" {
+		log.Notice("serving client on standard input/output")
+		if opts.noBanner {
+			logStartup(opts, "stdio")
+		}
+		handleConnection(newStdioConn(), opts)
+		return nil
+	}
+
+	var ln net.Listener
+	// Where the proxy listens, in the DOCKER_HOST format
+	var listen string
+	// Whether the files created until then may no longer be removable
+	var dropped bool
+	if opts.listenUmask >= 0 && (opts.listenFd >= 0 || opts.proxyNetwork == "tcp") {
+		log.Warning("-listen-umask only applies to Unix sockets created by the proxy, ignoring it")
+	}
+	if opts.listenFd >= 0 {
+		var err error
+		ln, err = listenOnFd(opts.listenFd)
+		if err != nil {
+			return fmt.Errorf("unable to use inherited listening socket: %w", err)
+		}
+		log.Noticef("listening on inherited socket at file descriptor %d", opts.listenFd)
+		listen = fmt.Sprintf("fd://%d", opts.listenFd)
+	} else if opts.proxyNetwork == "tcp" {
+		var err error
+		ln, err = net.Listen("tcp", opts.proxySock)
+		if err != nil {
+			return fmt.Errorf("unable to listen on TCP address: %w", err)
+		}
+		log.Notice("listening on proxy address", opts.proxySock)
+		listen = "tcp://" + opts.proxySock
+	} else {
+		var err error
+		if opts.proxySock, err = proxySocketPath(opts.proxySock, opts.abstractFallback); err != nil {
+			return err
+		}
+
+		// Ensure the socket either does not exist or can be removed
+		// Make the program fail otherwise. Abstract sockets don't live in the
+		// filesystem, so there's nothing to check.
+		if !isAbstract(opts.proxySock) {
+			if err := ensureSocketDoesNotExist(opts.proxySock, opts.quietSocketRemoval); err != nil {
+				return err
+			}
+		}
+
+		ln, err = listenUnix(opts.proxySock, opts.listenBacklog, opts.listenUmask)
+		if err != nil {
+			return fmt.Errorf("unable to listen to Unix socket: %w", err)
+		}
+		if isAbstract(opts.proxySock) {
+			log.Notice("listening on abstract proxy socket", opts.proxySock)
+		} else {
+			log.Notice("listening on proxy socket", opts.proxySock)
+		}
+		listen = "unix://" + opts.proxySock
+	}
+	if opts.noBanner {
+		logStartup(opts, listen)
+	}
+	defer func() {
+		// The listener may have already been closed on shutdown
+		_ = ln.Close()
+		if opts.listenFd < 0 && opts.proxyNetwork == "unix" && !isAbstract(opts.proxySock) {
+			removeCreatedFile(opts.proxySock, "proxy socket", dropped)
+		}
+	}()
+
+	if opts.metricsAddr != "" {
+		metricsLn, err := serveMetrics(opts.metricsAddr, opts.samples)
+		if err != nil {
+			return fmt.Errorf("unable to serve metrics: %w", err)
+		}
+		// Also removes the socket when serving on a Unix socket
+		defer metricsLn.Close()
+		log.Notice("serving metrics on", opts.metricsAddr)
+	}
+
+	if opts.pidFile != "" {
+		if err := writePidFile(opts.pidFile); err != nil {
+			return err
+		}
+		defer func() {
+			removeCreatedFile(opts.pidFile, "PID file", dropped)
+		}()
+	}
+
+	if opts.user != "" || opts.group != "" {
+		if err := dropPrivileges(opts.user, opts.group); err != nil {
+			return err
+		}
+		dropped = true
+		log.Noticef("running as uid %d, gid %d", os.Getuid(), os.Getgid())
+	}
+
+	// Stop accepting connections on SIGINT/SIGTERM so that we can clean up; the
+	// signals are caught right away, so that they can't kill the process anymore
+	stopping := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Noticef("received %s, shutting down", sig)
+		close(stopping)
+		if err := ln.Close(); err != nil {
+			log.Error("unable to close proxy socket:", err)
+		}
+	}()
+
+	logStatsOnSignal()
+	pauser := newAcceptPauser(ln)
+	pauseOnSignal(pauser)
+	if opts.upstreamCheckInterval > 0 {
+		go watchUpstream(opts, stopping)
+	}
+	if opts.idleTimeout > 0 {
+		go activeConns.reapIdle(opts.idleTimeout, opts.idleSweepInterval, stopping)
+	}
+
+	// One slot for each connection allowed at once; nil if unlimited
+	var slots chan struct{}
+	if opts.maxConnections > 0 {
+		slots = make(chan struct{}, opts.maxConnections)
+	}
+	var lastSaturationWarning time.Time
+	serve := func(conn net.Conn) {
+		if err := setConnBufferSizes(conn, opts.rcvBuf, opts.sndBuf); err != nil {
+			log.Warning("unable to set socket buffer sizes:", err)
+		}
+		if err := setNoDelay(conn, opts.tcpNoDelay); err != nil {
+			log.Warning("unable to set TCP_NODELAY on client connection:", err)
+		}
+		if slots == nil {
+			go serveClient(conn, opts)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			go func() {
+				serveClient(conn, opts)
+				<-slots
+			}()
+		default:
+			rejected := atomic.AddInt64(&stats.rejectedConnections, 1)
+			if time.Since(lastSaturationWarning) >= saturationWarningInterval {
+				log.Warningf("limit of %d connections reached, rejecting new ones (%d rejected so far)",
+					opts.maxConnections, rejected)
+				lastSaturationWarning = time.Now()
+			}
+			go rejectConnection(conn, "docker-platformify: too many connections, try again later")
+		}
+	}
+	rejectHeld := func(conn net.Conn) {
+		atomic.AddInt64(&stats.rejectedConnections, 1)
+		go rejectConnection(conn, "docker-platformify: not accepting connections for now, try again later")
+	}
+	// Connections accepted while paused, oldest first
+	var held []heldConn
+	serveHeld := func() {
+		if len(held) > 0 {
+			log.Infof("serving %d connections held while paused", len(held))
+		}
+		for _, h := range held {
+			serve(h.conn)
+		}
+		held = nil
+	}
+	// Grows while accepting connections keeps failing temporarily
+	var acceptDelay time.Duration
+	for {
+		select {
+		case <-stopping:
+			for _, h := range held {
+				_ = h.conn.Close()
+			}
+			activeConns.drain(opts.drainTimeout)
+			return nil
+		default:
+		}
+
+		if pauser.isPaused() {
+			for len(held) > 0 && !time.Now().Before(held[0].until) {
+				log.Infof("rejecting connection held for %s while paused", opts.pauseTimeout)
+				rejectHeld(held[0].conn)
+				held = held[1:]
+			}
+		}
+		var expiry time.Time
+		if len(held) > 0 {
+			expiry = held[0].until
+		}
+		if !pauser.prepareAccept(expiry) {
+			serveHeld()
+		}
+
+		if conn, err := ln.Accept(); err != nil {
+			select {
+			case <-stopping:
+				continue
+			default:
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					// Woken up to pause, to resume, or to reject the connections held for too long
+					continue
+				}
+				if err, ok := err.(net.Error); ok && err.Temporary() {
+					// E.g. out of file descriptors: back off rather than spinning
+					if acceptDelay *= 2; acceptDelay == 0 {
+						acceptDelay = 5 * time.Millisecond
+					} else if acceptDelay > time.Second {
+						acceptDelay = time.Second
+					}
+					log.Errorf("unable to accept connection, retrying in %s: %v", acceptDelay, err)
+					time.Sleep(acceptDelay)
+				} else {
+					log.Error("unable to accept connection:", err)
+				}
+			}
+		} else {
+			acceptDelay = 0
+			if !pauser.isPaused() {
+				// After the ones held until now
+				serveHeld()
+				serve(conn)
+			} else if len(held) >= maxHeldConnections || opts.pauseTimeout <= 0 {
+				log.Info("rejecting new connection while paused")
+				rejectHeld(conn)
+			} else {
+				log.Info("holding new connection while paused")
+				held = append(held, heldConn{conn, time.Now().Add(opts.pauseTimeout)})
+			}
+		}
+	}
+}
+
+// Check whether an argument names a log level rather than a platform
+func isLogLevel(arg string) bool {
+	_, err := logging.LogLevel(arg)
+	return err == nil
+}
+
 func main() {
-	fmt.Print(
-		"docker-platformify  Copyright (C) 2020  Davide Depau <davide@depau.eu>\n" +
-			"This program comes with ABSOLUTELY NO WARRANTY; This is free software,\n" +
-			"and you are welcome to redistribute it under certain conditions.\n\n",
-	)
+	// Keep the output of the healthcheck subcommand clean
+	if len(os.Args) > 1 && os.Args[1] == "ping" {
+		os.Exit(ping(os.Args[2:]))
+	}
 
-	if len(os.Args) < 4 {
-		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s <docker socket> <proxied socket> <platform string> [log level]\n", os.Args[0])
+	opts := &options{}
+	flag.StringVar(&opts.listenMode, "listen-mode", "socket",
+		"either 'socket' to serve on the proxied socket, or 'stdio' to serve a single client over standard input/output")
+	flag.BoolVar(&opts.failClosed, "fail-closed", false,
+		"reject requests that cannot be injected with a 500 error instead of forwarding them unmodified")
+	flag.DurationVar(&opts.slowPullThreshold, "slow-pull-warning", 0,
+		"log a warning for pulls still running after this long, e.g. 10m; 0 to disable")
+	flag.StringVar(&opts.platformParam, "platform-param", "platform",
+		"name of the query parameter the platform is injected as")
+	platformPreference := flag.String("platform-preference", "",
+		"comma-separated list of platforms to pull images for, the first one each image is available for wins")
+	flag.DurationVar(&opts.platformCacheTTL, "platform-cache-ttl", 10*time.Minute,
+		"how long to remember the platforms an image is available for when using -platform-preference")
+	flag.Var(&opts.extraParams, "inject-param",
+		"NAME=VALUE query parameter to set along with the platform; may be given more than once")
+	flag.StringVar(&opts.secondaryPlatform, "secondary-platform", "",
+		"after forwarding a pull, pull the image for this platform too in the background, e.g. to warm a cache")
+	flag.StringVar(&opts.defaultRegistry, "default-registry", "",
+		"pull images that don't name a registry from this one, e.g. a Docker Hub mirror, instead of docker.io")
+	flag.StringVar(&opts.checkPlatform, "check-platform", "",
+		"ask the daemon at startup whether it can run containers for the platform, and 'warn' or 'refuse' to start if it clearly can't")
+	flag.StringVar(&opts.platformMode, "platform-mode", "replace",
+		"'replace' to always inject the platform, 'default' to only inject it into requests that don't specify one")
+	flag.BoolVar(&opts.allowPlatformOverride, "allow-platform-override", false,
+		"let clients choose the platform of a request with the "+platformOverrideParam+" query parameter, which is then removed")
+	rulesPath := flag.String("rules", "",
+		"file with an ordered list of rules allowing, denying or choosing the platform of pulls by image")
+	flag.BoolVar(&opts.requireDigest, "require-digest", false,
+		"reject pulls of images that are not pinned by digest (name@sha256:...) with a 403 error")
+	flag.IntVar(&opts.listenFd, "listen-fd", -1,
+		"serve on an already open listening socket at this file descriptor instead of creating the proxied socket")
+	flag.IntVar(&opts.listenBacklog, "listen-backlog", 0,
+		"maximum length of the queue of pending connections to the proxied socket, capped by the system limit (default: system limit)")
+	listenUmask := flag.String("listen-umask", "",
+		"umask to create the proxied socket with, in octal, e.g. 007 to only let the owner and group connect")
+	flag.BoolVar(&opts.quietSocketRemoval, "quiet-socket-removal", false,
+		"log the removal of a stale proxied socket at DEBUG rather than INFO level")
+	flag.DurationVar(&opts.partialLineGrace, "partial-line-grace", time.Second,
+		"how long to wait for the rest of a request line received in pieces before forwarding it without the platform")
+	flag.BoolVar(&opts.assumeHTTPVersion, "assume-http-version", false,
+		"inject request lines without an HTTP version, e.g. 'POST /images/create', as HTTP/1.1 ones instead of forwarding them as is")
+	flag.DurationVar(&opts.upstreamCheckInterval, "upstream-check-interval", 0,
+		"check whether the Docker daemon is available this often, logging when it goes away or comes back, e.g. 5s")
+	flag.DurationVar(&opts.drainTimeout, "drain-timeout", 0,
+		"on shutdown, wait this long for active connections to finish before closing them, e.g. 30s")
+	flag.DurationVar(&opts.pauseTimeout, "pause-timeout", 30*time.Second,
+		"while paused with SIGTSTP, hold new connections this long waiting for SIGCONT before rejecting them; 0 to reject them right away")
+	flag.DurationVar(&opts.upstreamWriteTimeout, "upstream-write-timeout", 0,
+		"close connections whose data the Docker daemon doesn't accept within this long, e.g. 30s")
+	flag.IntVar(&opts.maxConnections, "max-connections", 0,
+		"serve at most this many connections at once, rejecting the others with a 503 error (default: no limit)")
+	flag.DurationVar(&opts.idleTimeout, "idle-timeout", 0,
+		"close connections that haven't forwarded anything for this long, e.g. 10m")
+	flag.DurationVar(&opts.idleSweepInterval, "idle-sweep-interval", 30*time.Second,
+		"how often to look for connections idle for longer than -idle-timeout")
+	flag.DurationVar(&opts.maxConnectionLifetime, "max-connection-lifetime", 0,
+		"close connections open for longer than this, even busy ones, e.g. 1h")
+	insecureListen := flag.Bool("insecure-listen", false,
+		"allow listening on a TCP address other than a loopback one, giving anyone who can reach it unencrypted, unauthenticated access to the Docker daemon")
+	flag.StringVar(&opts.abstractFallback, "abstract-fallback", "",
+		"when the proxied socket is an abstract one ('@name') and the system doesn't support those, listen on this path instead")
+	flag.StringVar(&opts.user, "user", "",
+		"user name or ID to switch to after creating the proxied socket")
+	flag.StringVar(&opts.group, "group", "",
+		"group name or ID to switch to after creating the proxied socket (default: the user's primary group)")
+	flag.StringVar(&opts.metricsAddr, "metrics-addr", "",
+		"serve Prometheus metrics at /metrics on this address, e.g. 127.0.0.1:9101 or unix:///run/docker-platformify-metrics.sock")
+	flag.Uint64Var(&opts.debugSampleRate, "debug-sample", 1,
+		"only log one in this many forwarded chunks at DEBUG level; injections and errors are always logged")
+	flag.BoolVar(&opts.debugGunzip, "debug-gunzip", false,
+		"decompress gzip-encoded bodies of forwarded data logged at DEBUG level")
+	logInstance := flag.String("log-instance", "",
+		"name of this proxy instance, to prefix every log line with")
+	logSocketPath := flag.Bool("log-socket-path", false,
+		"prefix every log line with the proxied socket path, unless -log-instance is given")
+	flag.BoolVar(&opts.noBanner, "no-banner", false,
+		"don't print the banner, log a single structured line with the listen address, upstream, platform and version instead")
+	shutdownSummary := flag.Bool("shutdown-summary", false,
+		"log the number of connections served, injections and errors, and the uptime on exit")
+	logCallerDepth := flag.Int("log-caller-depth", 0,
+		"skip this many extra stack frames when showing the calling function in log lines")
+	flag.StringVar(&opts.pidFile, "pidfile", "",
+		"write the process ID to this file, removing it on shutdown")
+	flag.BoolVar(&opts.rewriteInspectResponse, "rewrite-inspect-response", false,
+		"rewrite the Os/Architecture/Variant fields of image inspect responses to match the platform")
+	accessLogPath := flag.String("access-log", "",
+		"append a line for each rewritten request to this file")
+	accessLogFormat := flag.String("access-log-format", "common",
+		"format of the access log lines, either 'common' (Common Log Format followed by the platform) or 'json'")
+	samples := flag.Int("samples", 0,
+		"keep the last this many rewritten requests and serve them as JSON at /samples on -metrics-addr")
+	otlpEndpoint := flag.String("otlp-endpoint", "",
+		"export OpenTelemetry traces with OTLP/HTTP to this collector, e.g. http://localhost:4318")
+	platformFromSock := flag.Bool("platform-from-path", false,
+		"infer the platform from the proxied socket name, e.g. 'docker-linux-arm64.sock' injects 'linux/arm64'")
+	flag.IntVar(&opts.rcvBuf, "rcvbuf", 0,
+		"size in bytes of the kernel receive buffer (SO_RCVBUF) of client and Docker sockets; 0 for the system default")
+	flag.IntVar(&opts.sndBuf, "sndbuf", 0,
+		"size in bytes of the kernel send buffer (SO_SNDBUF) of client and Docker sockets; 0 for the system default")
+	flag.BoolVar(&opts.tcpNoDelay, "tcp-nodelay", true,
+		"set TCP_NODELAY on TCP client and Docker sockets, sending small writes right away; set to false to let Nagle's algorithm coalesce them")
+	clientExes := flag.String("client-exe", "",
+		"comma-separated list of executable paths or glob patterns; only requests from matching clients get the platform injected (Linux only)")
+	printCfg := flag.Bool("print-config", false,
+		"print the effective configuration as JSON and exit")
+	rewriteMethods := flag.String("rewrite-methods", "",
+		"comma-separated list of HTTP methods that trigger rewriting besides the ones used by each endpoint, e.g. PUT")
+	rewriteImagesCreate := flag.Bool("rewrite-images-create", true,
+		"inject the platform into 'POST /images/create' requests (docker pull)")
+	flag.BoolVar(&opts.firstPullOnly, "first-pull-only", false,
+		"only inject the platform into the first image create request of each connection, forwarding the others as is")
+	flag.BoolVar(&opts.rewriteImports, "rewrite-imports", false,
+		"also inject the platform into image imports ('POST /images/create?fromSrc=...', docker import)")
+	rewriteBuild := flag.Bool("rewrite-build", false,
+		"inject the platform into 'POST /build' requests (docker build)")
+	rewriteContainersCreate := flag.Bool("rewrite-containers-create", false,
+		"inject the platform into 'POST /containers/create' requests (docker create/run, needs API 1.41)")
+	rewriteImageInspect := flag.Bool("rewrite-image-inspect", false,
+		"inject the platform into 'GET /images/{name}/json' requests (needs a daemon supporting it)")
+	rewritePush := flag.Bool("rewrite-push", false,
+		"inject the platform into 'POST /images/{name}/push' requests (docker push, needs a daemon supporting it)")
+	flag.Var(&opts.minAPIVersions, "min-api-version",
+		"only rewrite requests for ENDPOINT (e.g. build) using API VERSION or later, given as ENDPOINT=VERSION; may be repeated")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [options] <docker socket> <proxied socket> <platform string> [log level]\n", os.Args[0])
 		_, _ = fmt.Fprintln(os.Stderr, "Log level can be one of: CRITICAL, ERROR, WARNING, NOTICE, INFO, DEBUG; default INFO")
-		os.Exit(1)
+		_, _ = fmt.Fprintln(os.Stderr, "When -listen-fd or -listen-mode=stdio is used, <proxied socket> must be omitted")
+		_, _ = fmt.Fprintln(os.Stderr, "When -platform-from-path is used, <platform string> must be omitted")
+		_, _ = fmt.Fprintln(os.Stderr, "When $TARGETPLATFORM is set, <platform string> may be omitted to use it")
+		_, _ = fmt.Fprintf(os.Stderr, "\nTo check whether a running proxy is healthy: %s ping -sock <proxied socket>\n", os.Args[0])
+		_, _ = fmt.Fprintln(os.Stderr, "\nOptions:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+
+	if opts.listenMode != "socket" && opts.listenMode != "stdio" {
+		failf(exitUsage, "invalid listen mode '%s'", opts.listenMode)
+	}
+	if opts.platformParam == "" || url.QueryEscape(opts.platformParam) != opts.platformParam {
+		failf(exitUsage, "invalid platform parameter name '%s'", opts.platformParam)
+	}
+	if opts.platformMode != "replace" && opts.platformMode != "default" {
+		failf(exitUsage, "invalid platform mode '%s'", opts.platformMode)
+	}
+	for _, param := range opts.extraParams {
+		if param.name == opts.platformParam {
+			failf(exitUsage, "the platform can't be set with -inject-param %s=...", param.name)
+		}
+	}
+	opts.listenUmask = -1
+	if *listenUmask != "" {
+		umask, err := strconv.ParseUint(*listenUmask, 8, 32)
+		if err != nil || umask > 0777 {
+			failf(exitUsage, "invalid umask '%s', expected an octal number such as 007", *listenUmask)
+		}
+		opts.listenUmask = int(umask)
+	}
+	if opts.checkPlatform != "" && opts.checkPlatform != "warn" && opts.checkPlatform != "refuse" {
+		failf(exitUsage, "invalid platform check mode '%s'", opts.checkPlatform)
+	}
+	if *samples < 0 || (*samples > 0 && opts.metricsAddr == "") {
+		failf(exitUsage, "-samples needs -metrics-addr and a positive number of requests")
+	}
+	if opts.idleTimeout > 0 && opts.idleSweepInterval <= 0 {
+		failf(exitUsage, "the idle sweep interval must be positive")
 	}
 
-	dockerSock := os.Args[1]
-	proxySock := os.Args[2]
-	platform := os.Args[3]
+	// Standard output carries the API stream in stdio mode
+	banner := os.Stdout
+	if opts.listenMode == "stdio" || *printCfg {
+		banner = os.Stderr
+	}
+	if !opts.noBanner {
+		_, _ = fmt.Fprint(banner,
+			"docker-platformify  Copyright (C) 2020  Davide Depau <davide@depau.eu>\n"+
+				"This program comes with ABSOLUTELY NO WARRANTY; This is free software,\n"+
+				"and you are welcome to redistribute it under certain conditions.\n\n",
+		)
+	}
+
+	positional := []*string{&opts.dockerSock, &opts.proxySock, &opts.platform}
+	if opts.listenFd >= 0 || opts.listenMode == "stdio" {
+		if *platformFromSock {
+			failf(exitUsage, "-platform-from-path needs a proxied socket path")
+		}
+		// There's no proxied socket path to create
+		positional = []*string{&opts.dockerSock, &opts.platform}
+	} else if *platformFromSock {
+		positional = []*string{&opts.dockerSock, &opts.proxySock}
+	}
+	// Where the platform comes from, shown by -print-config
+	platformSource := "argument"
+	// BuildKit sets $TARGETPLATFORM, which is used when the platform argument is left out
+	if target := os.Getenv("TARGETPLATFORM"); target != "" && positional[len(positional)-1] == &opts.platform {
+		last := len(positional) - 1
+		if len(args) == last || (len(args) == last+1 && isLogLevel(args[last])) {
+			opts.platform = target
+			platformSource = "TARGETPLATFORM"
+			positional = positional[:last]
+		}
+	}
+	if len(args) < len(positional) {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	for i, arg := range positional {
+		*arg = args[i]
+	}
+	args = args[len(positional):]
+
+	var err error
+	if opts.dockerNetwork, opts.dockerSock, err = parseHost(opts.dockerSock); err == nil && opts.dockerNetwork == "fd" {
+		err = errors.New("the Docker daemon can't be reached through a file descriptor")
+	}
+	if err == nil && opts.dockerNetwork == "tcp" {
+		opts.upstreamProxy, err = upstreamProxy(opts.dockerSock)
+	}
+	if err != nil {
+		failf(exitUsage, "invalid Docker socket: %v", err)
+	}
+	// Whether the proxy listens on a TCP address reachable from other hosts
+	exposed := false
+	if opts.listenFd < 0 && opts.listenMode != "stdio" {
+		var address string
+		if opts.proxyNetwork, address, err = parseHost(opts.proxySock); err != nil {
+			failf(exitUsage, "invalid proxied socket: %v", err)
+		}
+		if opts.proxyNetwork == "fd" {
+			if *platformFromSock {
+				failf(exitUsage, "-platform-from-path needs a proxied socket path")
+			}
+			opts.listenFd, _ = strconv.Atoi(address)
+		} else {
+			opts.proxySock = address
+		}
+		if opts.proxyNetwork == "tcp" && !isLoopbackAddress(address) {
+			// Anyone who can connect gets root-equivalent access to the daemon
+			if !*insecureListen {
+				failf(exitUsage, "refusing to listen on %s, which isn't a loopback address, without TLS: pass -insecure-listen to do it anyway", address)
+			}
+			exposed = true
+		}
+	}
+
+	if *platformFromSock {
+		platform, err := platformFromPath(opts.proxySock)
+		if err != nil {
+			failf(exitInvalidPlatform, "unable to infer platform from proxied socket: %v", err)
+		}
+		opts.platform = platform
+		platformSource = "proxied socket path"
+	}
+	opts.platform = normalizePlatform(opts.platform)
+	if platformOS, arch, _ := splitPlatform(opts.platform); platformOS == "" || arch == "" {
+		failf(exitInvalidPlatform, "invalid platform '%s', expected <os>/<arch>[/<variant>]", opts.platform)
+	}
+	opts.secondaryPlatform = normalizePlatform(opts.secondaryPlatform)
+	if platformOS, arch, _ := splitPlatform(opts.secondaryPlatform); opts.secondaryPlatform != "" && (platformOS == "" || arch == "") {
+		failf(exitInvalidPlatform, "invalid secondary platform '%s'", opts.secondaryPlatform)
+	}
+	for _, platform := range strings.Split(*platformPreference, ",") {
+		if platform = normalizePlatform(platform); platform == "" {
+			continue
+		}
+		if platformOS, arch, _ := splitPlatform(platform); platformOS == "" || arch == "" {
+			failf(exitInvalidPlatform, "invalid preferred platform '%s'", platform)
+		}
+		opts.platformPreference = append(opts.platformPreference, platform)
+	}
+	opts.defaultRegistry = strings.TrimSuffix(opts.defaultRegistry, "/")
+
+	for _, rewrite := range []struct {
+		enabled bool
+		ep      *endpoint
+	}{
+		{*rewriteImagesCreate, imagesCreate},
+		{*rewriteBuild, build},
+		{*rewriteContainersCreate, containersCreate},
+		{*rewriteImageInspect, imageInspect},
+		{*rewritePush, imagePush},
+	} {
+		if rewrite.enabled {
+			opts.endpoints = append(opts.endpoints, rewrite.ep)
+		}
+	}
+	for _, method := range strings.Split(*rewriteMethods, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			opts.extraMethods = append(opts.extraMethods, method)
+		}
+	}
+	if *rulesPath != "" {
+		rules, err := loadRules(*rulesPath)
+		if err != nil {
+			fail(&exitError{exitUsage, err})
+		}
+		opts.rules = rules
+	}
+	for _, exe := range strings.Split(*clientExes, ",") {
+		if exe = strings.TrimSpace(exe); exe != "" {
+			opts.clientExes = append(opts.clientExes, exe)
+		}
+	}
 
 	// Setup logging
-	if len(os.Args) > 4 {
-		level, err := logging.LogLevel(os.Args[4])
+	level := logging.INFO
+	if len(args) > 0 {
+		var err error
+		level, err = logging.LogLevel(args[0])
 		if err != nil {
-			fmt.Println("unable to set log level:", err)
-			os.Exit(1)
+			failf(exitUsage, "unable to set log level: %v", err)
+		}
+	}
+	logging.SetLevel(level, "docker-platformify")
+	if *logInstance == "" && *logSocketPath {
+		*logInstance = opts.proxySock
+		if opts.listenFd >= 0 {
+			*logInstance = fmt.Sprintf("fd %d", opts.listenFd)
 		}
-		logging.SetLevel(level, "docker-platformify")
-	} else {
-		logging.SetLevel(logging.INFO, "docker-platformify")
+	}
+	if *logInstance != "" {
+		// Tell apart the lines of proxies sharing a log sink
+		format = newCallerFormatter(strings.Replace(logFormat, "%{message}", "["+*logInstance+"] %{message}", 1))
 	}
 	logging.SetFormatter(format)
+	log.ExtraCalldepth = *logCallerDepth
 
-	// Ensure the socket either does not exist or can be removed
-	// Make the program fail otherwise
-	if err := ensureSocketDoesNotExist(proxySock); err != nil {
-		log.Fatal(err)
+	if *printCfg {
+		if err := printConfig(os.Stdout, opts, level, platformSource); err != nil {
+			fail(err)
+		}
+		os.Exit(0)
 	}
 
-	ln, err := net.Listen("unix", proxySock)
-	if err != nil {
-		log.Fatal("unable to listen to Unix socket:", err)
+	if opts.upstreamProxy != nil {
+		log.Notice("connecting to the Docker daemon through HTTP proxy", redactURL(opts.upstreamProxy.String()))
 	}
-	log.Notice("listening on proxy socket", proxySock)
-	for {
-		if conn, err := ln.Accept(); err != nil {
-			log.Error("unable to accept connection:", err)
-		} else {
-			log.Info("new connection to proxy socket")
-			go handleConnection(conn, dockerSock, platform)
+	if exposed {
+		log.Warningf("listening on %s without TLS nor authentication: anyone who can reach it has root access to the Docker daemon", opts.proxySock)
+	}
+	if isHostPlatform(opts.platform) {
+		log.Noticef("%s is the platform of this host, which Docker already uses by default: the proxy may be unnecessary", opts.platform)
+	}
+	if opts.checkPlatform != "" {
+		if reason, err := unsupportedPlatform(opts); err != nil && opts.checkPlatform == "refuse" {
+			failf(exitCode(err), "unable to check whether the daemon supports the platform: %v", err)
+		} else if err != nil {
+			log.Warning("unable to check whether the daemon supports the platform:", err)
+		} else if reason != "" && opts.checkPlatform == "refuse" {
+			failf(exitUnsupportedPlatform, "the daemon can't run %s containers: %s", opts.platform, reason)
+		} else if reason != "" {
+			log.Warningf("the daemon can pull %s images but likely can't run them: %s", opts.platform, reason)
 		}
 	}
+	toggleDebugOnSignal(level)
+
+	if *otlpEndpoint != "" {
+		opts.tracer = newTracer(*otlpEndpoint)
+	}
+	if *samples > 0 {
+		opts.samples = newSampleRing(*samples)
+	}
+	if *accessLogPath != "" {
+		var err error
+		if opts.accessLog, err = openAccessLog(*accessLogPath, *accessLogFormat); err != nil {
+			fail(err)
+		}
+	}
+
+	started := time.Now()
+	if err := run(opts); err != nil {
+		fail(err)
+	}
+	if *shutdownSummary {
+		log.Notice(stats.summary(time.Since(started)))
+	}
 }
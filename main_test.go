@@ -0,0 +1,1900 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// Holds the arguments, as a JSON list, to run main with instead of the tests;
+// see mainCommand
+const mainArgsEnv = "PLATFORMIFY_TEST_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if encoded := os.Getenv(mainArgsEnv); encoded != "" {
+		var args []string
+		if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+			panic(err)
+		}
+		os.Args = append([]string{"docker-platformify"}, args...)
+		// Without the flags of the tests
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		main()
+		os.Exit(0)
+	}
+	// Set once and for all: go-logging doesn't synchronize changes with goroutines logging, which may outlive a test.
+	// Nothing is written to stderr, where connections being closed by the tests would be logged as errors.
+	logging.SetBackend(testLogs)
+	logging.SetLevel(logging.INFO, "docker-platformify")
+	os.Exit(m.Run())
+}
+
+// Run the proxy with the given arguments in a subprocess, in an environment
+// cleared of the variables it reads plus env
+func mainCommand(t *testing.T, env []string, args ...string) *exec.Cmd {
+	t.Helper()
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0])
+	for _, variable := range os.Environ() {
+		name := strings.ToUpper(variable[:strings.IndexByte(variable, '=')])
+		if name != "TARGETPLATFORM" && !strings.HasSuffix(name, "_PROXY") {
+			cmd.Env = append(cmd.Env, variable)
+		}
+	}
+	// The race detector would wait a second on exit
+	cmd.Env = append(append(cmd.Env, env...), mainArgsEnv+"="+string(encoded), "GORACE=atexit_sleep_ms=0")
+	return cmd
+}
+
+// Run the proxy until it exits, returning its output and exit code
+func runMain(t *testing.T, env []string, args ...string) (stdout string, stderr string, code int) {
+	t.Helper()
+	cmd := mainCommand(t, env, args...)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatal("unable to run the proxy:", err)
+		}
+		code = exitErr.ExitCode()
+	}
+	return out.String(), errOut.String(), code
+}
+
+// The log of a proxy running in a subprocess, line by line
+type proxyLog struct {
+	lines chan string
+}
+
+// Wait for a line containing substring to be logged, returning it
+func (l *proxyLog) waitFor(t *testing.T, substring string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-l.lines:
+			if !ok {
+				t.Fatalf("the proxy exited without logging '%s'", substring)
+			}
+			if strings.Contains(line, substring) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("the proxy didn't log '%s'", substring)
+		}
+	}
+}
+
+// Start the proxy in a subprocess, which is killed at the end of the test if
+// still running
+func startProxy(t *testing.T, env []string, args ...string) (*exec.Cmd, *proxyLog) {
+	t.Helper()
+	cmd := mainCommand(t, env, args...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal("unable to start the proxy:", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	log := &proxyLog{lines: make(chan string, 1024)}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.lines <- scanner.Text()
+		}
+		close(log.lines)
+	}()
+	return cmd, log
+}
+
+// Serve HTTP on a Unix socket until the end of the test
+func serveUnix(t *testing.T, path string, handler http.Handler) {
+	t.Helper()
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(func() { _ = server.Close() })
+}
+
+// Send a request to a proxy over a Unix socket, returning the status of the
+// response
+func requestUnix(t *testing.T, path string, method string, target string) int {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal("unable to connect to the proxy:", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: docker\r\n\r\n", method, target); err != nil {
+		t.Fatal("unable to send request:", err)
+	}
+	return readResponse(t, bufio.NewReader(conn))
+}
+
+// Options injecting linux/arm64 into pulls, with a fake daemon
+func testOptions(daemon *fakeDaemon) *options {
+	return &options{
+		platform:         "linux/arm64",
+		platformParam:    "platform",
+		platformMode:     "replace",
+		endpoints:        []*endpoint{imagesCreate},
+		partialLineGrace: time.Second,
+		listenFd:         -1,
+		dial:             daemon.dial,
+	}
+}
+
+// A Docker daemon answering every request with an empty 200 response, unless
+// told otherwise by reply, which records what it receives
+type fakeDaemon struct {
+	dials int32
+	// Gives the raw response to a request, with its index on its connection,
+	// and whether to hang up after sending it; may be nil
+	reply func(n int, req *http.Request) (response string, hangUp bool)
+
+	mu sync.Mutex
+	// Everything received on all the connections, in order
+	raw bytes.Buffer
+	// Requests received, with their bodies read
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (d *fakeDaemon) dial(context.Context) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	proxySide, daemonSide, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	go d.serve(daemonSide)
+	return proxySide, nil
+}
+
+// Create a pair of connected unix sockets; unlike with net.Pipe, deadlines can
+// still be set on one end once the other has been closed, as with the Docker socket
+func socketPair() (net.Conn, net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conns [2]net.Conn
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FileConn(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return conns[0], conns[1], nil
+}
+
+func (d *fakeDaemon) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(io.TeeReader(conn, lockedWriter{&d.mu, &d.raw}))
+	for n := 0; ; n++ {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		d.mu.Lock()
+		d.requests = append(d.requests, req)
+		d.bodies = append(d.bodies, body)
+		d.mu.Unlock()
+		response, hangUp := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false
+		if d.reply != nil {
+			response, hangUp = d.reply(n, req)
+		}
+		if _, err := conn.Write([]byte(response)); err != nil || hangUp {
+			return
+		}
+	}
+}
+
+func (d *fakeDaemon) received() (raw string, requests []*http.Request, bodies [][]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.raw.String(), append([]*http.Request{}, d.requests...), append([][]byte{}, d.bodies...)
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w lockedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
+
+// Run a connection served by handleConnection, on which talk plays the client
+func proxyConnection(t *testing.T, opts *options, talk func(client net.Conn, reader *bufio.Reader)) {
+	t.Helper()
+	client, proxied := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(proxied, opts)
+		close(done)
+	}()
+	defer func() {
+		_ = client.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("the connection wasn't closed")
+		}
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	talk(client, bufio.NewReader(client))
+}
+
+// Read a whole response, returning its status code
+func readResponse(t *testing.T, reader *bufio.Reader) int {
+	t.Helper()
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal("unable to read response:", err)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Send requests through a connection served by handleConnection, each after
+// the response to the previous one, and return the status codes of the
+// responses
+func proxyRequests(t *testing.T, opts *options, requests ...string) []int {
+	t.Helper()
+	var statuses []int
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		for _, request := range requests {
+			if _, err := client.Write([]byte(request)); err != nil {
+				t.Fatal("unable to send request:", err)
+			}
+			statuses = append(statuses, readResponse(t, reader))
+		}
+	})
+	return statuses
+}
+
+func TestHandleConnectionDialsForEachConnection(t *testing.T) {
+	daemon := &fakeDaemon{}
+	opts := testOptions(daemon)
+	for i := 0; i < 3; i++ {
+		proxyRequests(t, opts, "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\n\r\n")
+	}
+
+	if dials := atomic.LoadInt32(&daemon.dials); dials != 3 {
+		t.Errorf("daemon dialed %d times, expected 3", dials)
+	}
+	_, requests, _ := daemon.received()
+	if len(requests) != 3 {
+		t.Fatalf("daemon received %d requests, expected 3", len(requests))
+	}
+	for _, req := range requests {
+		if platform := req.URL.Query().Get("platform"); platform != "linux/arm64" {
+			t.Errorf("request has platform '%s', expected linux/arm64", platform)
+		}
+	}
+}
+
+func TestHandleConnectionDoesNotLookIntoBodies(t *testing.T) {
+	// A build context smuggling a request line, which must reach the daemon untouched
+	body := "\nPOST /v1.41/images/create?fromImage=evil HTTP/1.1\r\nHost: docker\r\n\r\n"
+	chunkedBody := fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{
+			name:    "with content length",
+			request: fmt.Sprintf("POST /v1.41/build HTTP/1.1\r\nHost: docker\r\nContent-Length: %d\r\n\r\n%s", len(body), body),
+		},
+		{
+			name:    "chunked",
+			request: "POST /v1.41/build HTTP/1.1\r\nHost: docker\r\nTransfer-Encoding: chunked\r\n\r\n" + chunkedBody,
+		},
+	}
+
+	for _, test := range tests {
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.endpoints = []*endpoint{imagesCreate, build}
+		pull := "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\n\r\n"
+		proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+			// Pipelined, so that the next request follows the body in the same read
+			if _, err := client.Write([]byte(test.request + pull)); err != nil {
+				t.Fatal("unable to send requests:", err)
+			}
+			readResponse(t, reader)
+			readResponse(t, reader)
+		})
+
+		_, requests, bodies := daemon.received()
+		if len(requests) != 2 {
+			t.Fatalf("%s: daemon received %d requests, expected 2", test.name, len(requests))
+		}
+		if string(bodies[0]) != body {
+			t.Errorf("%s: build body was changed to %q", test.name, bodies[0])
+		}
+		for i, req := range requests {
+			if platform := req.URL.Query().Get("platform"); platform != "linux/arm64" {
+				t.Errorf("%s: request %d has platform '%s', expected linux/arm64", test.name, i, platform)
+			}
+		}
+	}
+}
+
+func TestHandleConnectionWarnsAboutIncompleteResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		warning  bool
+	}{
+		{name: "closed after the response", response: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n{}"},
+		{name: "closed before responding", warning: true},
+		{name: "closed during the response", response: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n{", warning: true},
+	}
+
+	for _, test := range tests {
+		logs := recordLogs(t, logging.WARNING)
+		daemon := &fakeDaemon{reply: func(int, *http.Request) (string, bool) { return test.response, true }}
+		proxyConnection(t, testOptions(daemon), func(client net.Conn, reader *bufio.Reader) {
+			if _, err := client.Write([]byte("GET /v1.41/info HTTP/1.1\r\nHost: docker\r\n\r\n")); err != nil {
+				t.Fatal("unable to send request:", err)
+			}
+			// Wait for the daemon to hang up
+			_, _ = io.Copy(ioutil.Discard, reader)
+		})
+
+		if warned := logs.contains(logging.WARNING, "closed the connection before responding"); warned != test.warning {
+			t.Errorf("%s: warned about an incomplete response: %t, expected %t; logged %q", test.name, warned, test.warning, logs.messages(logging.DEBUG, ""))
+		}
+	}
+}
+
+func TestHandleConnectionWarnsAboutSlowPulls(t *testing.T) {
+	const threshold = 50 * time.Millisecond
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		warning bool
+	}{
+		{name: "fast pull on a kept-alive connection"},
+		{name: "slow pull", delay: 3 * threshold, warning: true},
+	}
+
+	for _, test := range tests {
+		logs := recordLogs(t, logging.WARNING)
+		delay := test.delay
+		daemon := &fakeDaemon{reply: func(int, *http.Request) (string, bool) {
+			time.Sleep(delay)
+			return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false
+		}}
+		opts := testOptions(daemon)
+		opts.slowPullThreshold = threshold
+		proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+			if _, err := client.Write([]byte("POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\n\r\n")); err != nil {
+				t.Fatal("unable to send request:", err)
+			}
+			readResponse(t, reader)
+			// Keep the connection open past the threshold
+			time.Sleep(3 * threshold)
+		})
+
+		if warned := logs.contains(logging.WARNING, "pull of alpine still running"); warned != test.warning {
+			t.Errorf("%s: warned about a slow pull: %t, expected %t; logged %q", test.name, warned, test.warning, logs.messages(logging.DEBUG, ""))
+		}
+	}
+}
+
+func TestHandleConnectionPullsSecondaryPlatformAfterwards(t *testing.T) {
+	daemon := &fakeDaemon{}
+	early := make(chan bool, 1)
+	daemon.reply = func(_ int, req *http.Request) (string, bool) {
+		if strings.HasPrefix(req.URL.Path, "/distribution/") {
+			body := `{"Descriptor":{"digest":"sha256:0123"},"Platforms":[]}`
+			return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body), false
+		}
+		if req.URL.Query().Get("platform") == "linux/arm64" {
+			// Give an early secondary pull the time to show up
+			time.Sleep(100 * time.Millisecond)
+			_, requests, _ := daemon.received()
+			early <- len(requests) > 1
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false
+	}
+	opts := testOptions(daemon)
+	opts.secondaryPlatform = "linux/amd64"
+	proxyRequests(t, opts, "POST /v1.41/images/create?fromImage=alpine&tag=3.18 HTTP/1.1\r\nHost: docker\r\n\r\n")
+
+	if <-early {
+		t.Error("the secondary pull started before the client's pull was over")
+	}
+	var requests []*http.Request
+	for deadline := time.Now().Add(5 * time.Second); len(requests) < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		_, requests, _ = daemon.received()
+	}
+	if len(requests) != 3 {
+		t.Fatalf("daemon received %d requests, expected 3", len(requests))
+	}
+	if path := requests[1].URL.Path; path != "/distribution/alpine:3.18/json" {
+		t.Errorf("the digest was looked up at %s", path)
+	}
+	query := requests[2].URL.Query()
+	if image, tag, platform := query.Get("fromImage"), query.Get("tag"), query.Get("platform"); image != "alpine" ||
+		tag != "sha256:0123" || platform != "linux/amd64" {
+		t.Errorf("secondary pull of fromImage=%s tag=%s platform=%s, expected alpine, sha256:0123 and linux/amd64", image, tag, platform)
+	}
+	// The client's connection, and a single one shared by the lookup and the secondary pull
+	if dials := atomic.LoadInt32(&daemon.dials); dials != 2 {
+		t.Errorf("the daemon was dialed %d times, expected twice", dials)
+	}
+}
+
+func TestHandleConnectionTagsImagesFromDefaultRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		tag     string
+	}{
+		{
+			name:    "official image",
+			request: "POST /v1.41/images/create?fromImage=alpine&tag=3.18 HTTP/1.1\r\nHost: docker\r\n\r\n",
+			tag:     "/images/mirror.local/library/alpine:3.18/tag?repo=alpine&tag=3.18",
+		},
+		{
+			name:    "tag in the image",
+			request: "POST /v1.41/images/create?fromImage=grafana%2Fgrafana%3A10 HTTP/1.1\r\nHost: docker\r\n\r\n",
+			tag:     "/images/mirror.local/grafana/grafana:10/tag?repo=grafana%2Fgrafana&tag=10",
+		},
+		{
+			name:    "digest",
+			request: "POST /v1.41/images/create?fromImage=alpine&tag=sha256%3A0123 HTTP/1.1\r\nHost: docker\r\n\r\n",
+		},
+		{
+			name:    "other registry",
+			request: "POST /v1.41/images/create?fromImage=ghcr.io%2Fowner%2Fimage&tag=1 HTTP/1.1\r\nHost: docker\r\n\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		daemon := &fakeDaemon{}
+		tagged := make(chan string, 1)
+		daemon.reply = func(_ int, req *http.Request) (string, bool) {
+			if strings.HasSuffix(req.URL.Path, "/tag") {
+				tagged <- req.URL.RequestURI()
+				return "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n", false
+			}
+			return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false
+		}
+		opts := testOptions(daemon)
+		opts.defaultRegistry = "mirror.local"
+		proxyRequests(t, opts, test.request)
+
+		// The image is tagged before the client gets the end of the response
+		select {
+		case uri := <-tagged:
+			if uri != test.tag {
+				t.Errorf("%s: tagged with %s, expected %s", test.name, uri, test.tag)
+			}
+		default:
+			if test.tag != "" {
+				t.Errorf("%s: the image wasn't tagged", test.name)
+			}
+		}
+	}
+}
+
+func TestParseRequestLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		target string
+		valid  bool
+	}{
+		{line: "GET /info HTTP/1.1\r", target: "/info", valid: true},
+		{line: "GET /info HTTP/1.1", target: "/info", valid: true},
+		{line: "GET  \t/info \tHTTP/1.1\r", target: "/info", valid: true},
+		{line: "POST /images/create?fromImage=alpine HTTP/1.0", target: "/images/create?fromImage=alpine", valid: true},
+		{line: ""},
+		{line: "GET"},
+		{line: " /info HTTP/1.1"},
+		{line: "GET /info"},
+		{line: "GET /info \r"},
+		{line: "GET  HTTP/1.1"},
+	}
+
+	for _, test := range tests {
+		start, end, err := parseRequestLine([]byte(test.line))
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got error %v, expected the line to be valid: %t", test.line, err, test.valid)
+		} else if test.valid && test.line[start:end] != test.target {
+			t.Errorf("%q: got target %q, expected %q", test.line, test.line[start:end], test.target)
+		}
+	}
+}
+
+func TestWithHTTPVersion(t *testing.T) {
+	tests := []struct {
+		line  string
+		fixed string
+	}{
+		{"POST /images/create?fromImage=alpine\r", "POST /images/create?fromImage=alpine HTTP/1.1\r"},
+		{"POST /images/create?fromImage=alpine", "POST /images/create?fromImage=alpine HTTP/1.1"},
+		{"POST /images/create?fromImage=alpine \t\r", "POST /images/create?fromImage=alpine HTTP/1.1\r"},
+		// Nothing to fix
+		{"POST /images/create HTTP/1.0\r", ""},
+		// Not fixable by adding a version
+		{"POST\r", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		fixed, ok := withHTTPVersion([]byte(test.line))
+		if ok != (test.fixed != "") || (ok && string(fixed) != test.fixed) {
+			t.Errorf("%q: got %q, %t, expected %q", test.line, fixed, ok, test.fixed)
+		} else if !ok && string(fixed) != test.line {
+			t.Errorf("%q: changed to %q without being fixed", test.line, fixed)
+		}
+	}
+}
+
+func TestHandleConnectionAssumeHTTPVersion(t *testing.T) {
+	request := "POST /v1.41/images/create?fromImage=alpine\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	for _, assume := range []bool{false, true} {
+		logs := recordLogs(t, logging.INFO)
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.assumeHTTPVersion = assume
+		proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+			if _, err := io.WriteString(client, request); err != nil {
+				t.Fatal("unable to send request:", err)
+			}
+			if assume {
+				if status := readResponse(t, reader); status != http.StatusOK {
+					t.Errorf("got status %d", status)
+				}
+			} else {
+				// The daemon can't make sense of the request and hangs up
+				_, _ = io.Copy(ioutil.Discard, reader)
+			}
+		})
+
+		raw, _, _ := daemon.received()
+		expected := "POST /v1.41/images/create?fromImage=alpine\r\n"
+		if assume {
+			expected = "POST /v1.41/images/create?fromImage=alpine&platform=linux%2Farm64 HTTP/1.1\r\n"
+		}
+		if !strings.HasPrefix(raw, expected) {
+			t.Errorf("assume HTTP version: %t: daemon received %q, expected %q", assume, raw, expected)
+		}
+		if assumed := logs.contains(logging.INFO, "has no HTTP version, assuming HTTP/1.1"); assumed != assume {
+			t.Errorf("assume HTTP version: %t: assuming it logged: %t", assume, assumed)
+		}
+	}
+}
+
+func TestCanAppendPlatform(t *testing.T) {
+	tests := []struct {
+		url       string
+		canAppend bool
+	}{
+		{"/v1.41/build", true},
+		{"/v1.41/images/create?fromImage=alpine&tag=3.18", true},
+		{"/images/create?fromImage=alpine%2Fplatform", true},
+		{"/images/platform/json?", true},
+		{"/images/create?fromImage=alpine&platform=linux%2Famd64", false},
+		{"/images/create?platform", false},
+		// Escaped keys may decode to the parameter name
+		{"/images/create?%70latform=linux", false},
+		{"/images/create?fromImage=%zz", false},
+		{"/images/create?fromImage=alpine%", false},
+		{"/images/create?fromImage=alpine;tag=3", false},
+		{"/images/create#fragment", false},
+		{"/images/create?fromImage=al\x7fpine", false},
+	}
+
+	for _, test := range tests {
+		if canAppend := canAppendPlatform([]byte(test.url), "platform"); canAppend != test.canAppend {
+			t.Errorf("%q: got %t, expected %t", test.url, canAppend, test.canAppend)
+		}
+	}
+}
+
+func TestInjectPlatform(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		param    string
+		platform string
+		injected string
+	}{
+		{
+			name:     "appended",
+			line:     "POST /v1.41/images/create?fromImage=alpine&tag=3.18 HTTP/1.1\r",
+			injected: "POST /v1.41/images/create?fromImage=alpine&tag=3.18&platform=linux%2Farm64 HTTP/1.1\r",
+		},
+		{
+			name:     "without query",
+			line:     "POST /v1.41/build HTTP/1.1\r",
+			injected: "POST /v1.41/build?platform=linux%2Farm64 HTTP/1.1\r",
+		},
+		{
+			name:     "empty query",
+			line:     "POST /v1.41/build? HTTP/1.1",
+			injected: "POST /v1.41/build?platform=linux%2Farm64 HTTP/1.1",
+		},
+		{
+			name:     "blanks kept",
+			line:     "POST \t/build  HTTP/1.1\r",
+			injected: "POST \t/build?platform=linux%2Farm64  HTTP/1.1\r",
+		},
+		{
+			name:     "replaced",
+			line:     "POST /images/create?platform=linux%2Famd64&fromImage=alpine HTTP/1.1\r",
+			injected: "POST /images/create?fromImage=alpine&platform=linux%2Farm64 HTTP/1.1\r",
+		},
+		{
+			name:     "duplicates replaced",
+			line:     "POST /images/create?fromImage=alpine&platform=a&platform=b HTTP/1.1\r",
+			injected: "POST /images/create?fromImage=alpine&platform=linux%2Farm64 HTTP/1.1\r",
+		},
+		{
+			name:     "other parameter name",
+			line:     "POST /images/create?fromImage=alpine HTTP/1.1\r",
+			param:    "arch",
+			platform: "linux/arm/v7",
+			injected: "POST /images/create?fromImage=alpine&arch=linux%2Farm%2Fv7 HTTP/1.1\r",
+		},
+		{
+			name:     "JSON platform",
+			line:     "POST /images/alpine/push HTTP/1.1\r",
+			platform: `{"os":"linux","architecture":"arm64"}`,
+			injected: "POST /images/alpine/push?platform=%7B%22os%22%3A%22linux%22%2C%22architecture%22%3A%22arm64%22%7D HTTP/1.1\r",
+		},
+		{name: "without version", line: "POST /images/create?fromImage=alpine"},
+		{name: "garbage", line: "POST"},
+	}
+
+	for _, test := range tests {
+		param, platform := test.param, test.platform
+		if param == "" {
+			param = "platform"
+		}
+		if platform == "" {
+			platform = "linux/arm64"
+		}
+		injected, err := injectPlatform([]byte(test.line), param, platform)
+		if test.injected == "" {
+			if err == nil {
+				t.Errorf("%s: got %q, expected an error", test.name, injected)
+			}
+		} else if err != nil || string(injected) != test.injected {
+			t.Errorf("%s: got %q and error %v, expected %q", test.name, injected, err, test.injected)
+		}
+	}
+}
+
+func TestTakePlatformOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		platform string
+		stripped string
+	}{
+		{
+			name:     "valid",
+			line:     "POST /v1.41/images/create?fromImage=alpine&__platformify=Linux%2FARM64 HTTP/1.1\r",
+			platform: "linux/arm64",
+			stripped: "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r",
+		},
+		{
+			name:     "empty",
+			line:     "POST /v1.41/images/create?__platformify=&fromImage=alpine HTTP/1.1\r",
+			stripped: "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r",
+		},
+		{
+			name:     "absent",
+			line:     "POST /v1.41/images/create?fromImage=__platformify HTTP/1.1\r",
+			stripped: "POST /v1.41/images/create?fromImage=__platformify HTTP/1.1\r",
+		},
+		{name: "invalid", line: "POST /v1.41/images/create?fromImage=alpine&__platformify=arm64 HTTP/1.1\r"},
+	}
+
+	for _, test := range tests {
+		platform, stripped, err := takePlatformOverride([]byte(test.line))
+		if test.stripped == "" {
+			if err == nil {
+				t.Errorf("%s: got %q, expected an error", test.name, stripped)
+			}
+		} else if err != nil || platform != test.platform || string(stripped) != test.stripped {
+			t.Errorf("%s: got %q, %q and error %v, expected %q and %q", test.name, platform, stripped, err, test.platform, test.stripped)
+		}
+	}
+}
+
+func TestHandleConnectionLogsPullSummary(t *testing.T) {
+	logs := recordLogs(t, logging.INFO)
+	daemon := &fakeDaemon{}
+	proxyRequests(t, testOptions(daemon), "POST /v1.41/images/create?fromImage=alpine&tag=3.19 HTTP/1.1\r\nHost: docker\r\n\r\n")
+
+	if summaries := logs.messages(logging.INFO, "pull "); len(summaries) != 1 || summaries[0] != "pull alpine:3.19 platform=linux/arm64" {
+		t.Errorf("got pull summaries %q, expected 'pull alpine:3.19 platform=linux/arm64'", summaries)
+	}
+}
+
+func TestInjectPlatformPathsAgree(t *testing.T) {
+	lines := []string{
+		"POST /v1.41/images/create?fromImage=alpine&tag=3.18 HTTP/1.1\r",
+		"POST /v1.41/images/create?fromImage=ghcr.io%2Fowner%2Fimage&tag=1&fromImage=x HTTP/1.1\r",
+		"POST /v1.41/build HTTP/1.1\r",
+		"POST /v1.41/build? HTTP/1.1\r",
+		"POST /v1.41/build?t=app&buildargs=%7B%22A%22%3A%221%22%7D& HTTP/1.1\r",
+		"POST  /images/platform/push HTTP/1.0",
+	}
+
+	for _, line := range lines {
+		buffer := []byte(line)
+		urlStart, urlEnd, err := parseRequestLine(buffer)
+		if err != nil || !canAppendPlatform(buffer[urlStart:urlEnd], "platform") {
+			t.Fatalf("%q: doesn't take the fast path", line)
+		}
+		fast := appendPlatform(buffer, urlEnd, "platform", "linux/arm/v7")
+		slow, err := replacePlatform(buffer, urlStart, urlEnd, "platform", "linux/arm/v7")
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+
+		fastStart, fastEnd, _ := parseRequestLine(fast)
+		slowStart, slowEnd, _ := parseRequestLine(slow)
+		if string(fast[:fastStart]) != string(slow[:slowStart]) || string(fast[fastEnd:]) != string(slow[slowEnd:]) {
+			t.Errorf("%q: the paths disagree outside of the target: %q and %q", line, fast, slow)
+		}
+		fastUrl, fastErr := url.Parse(string(fast[fastStart:fastEnd]))
+		slowUrl, slowErr := url.Parse(string(slow[slowStart:slowEnd]))
+		if fastErr != nil || slowErr != nil || fastUrl.Path != slowUrl.Path ||
+			!reflect.DeepEqual(fastUrl.Query(), slowUrl.Query()) {
+			t.Errorf("%q: the paths disagree: %q and %q", line, fast, slow)
+		}
+	}
+}
+
+func BenchmarkInjectPlatform(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		line string
+	}{
+		{"fast", "POST /v1.41/images/create?fromImage=alpine&tag=3.18 HTTP/1.1\r"},
+		{"slow", "POST /v1.41/images/create?fromImage=alpine&tag=3.18&platform=linux%2Famd64 HTTP/1.1\r"},
+	}
+
+	for _, benchmark := range benchmarks {
+		line := []byte(benchmark.line)
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := injectPlatform(line, "platform", "linux/arm64"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleConnectionConcurrently(t *testing.T) {
+	// Large enough to take many reads in both directions, and full of lookalike request lines
+	body := strings.Repeat("\nPOST /v1.41/images/create?fromImage=evil HTTP/1.1\r\n", 2000)
+	progress := strings.Repeat(`{"status":"Downloading","progressDetail":{"current":1,"total":2}}`+"\n", 4000)
+	daemon := &fakeDaemon{reply: func(_ int, req *http.Request) (string, bool) {
+		if req.URL.Path == "/v1.41/images/create" {
+			return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(progress), progress), false
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false
+	}}
+	opts := testOptions(daemon)
+	opts.endpoints = []*endpoint{imagesCreate, build}
+	const connections = 8
+
+	t.Run("group", func(t *testing.T) {
+		for i := 0; i < connections; i++ {
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				t.Parallel()
+				proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+					// Written while the responses are being read
+					go func() {
+						_, _ = client.Write([]byte("POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\n\r\n" +
+							fmt.Sprintf("POST /v1.41/build HTTP/1.1\r\nHost: docker\r\nContent-Length: %d\r\n\r\n%s", len(body), body)))
+					}()
+					for n := 0; n < 2; n++ {
+						resp, err := http.ReadResponse(reader, nil)
+						if err != nil {
+							t.Fatal("unable to read response:", err)
+						}
+						received, err := ioutil.ReadAll(resp.Body)
+						_ = resp.Body.Close()
+						if n == 0 && (err != nil || string(received) != progress) {
+							t.Errorf("got %d bytes of progress and error %v, expected %d bytes", len(received), err, len(progress))
+						}
+					}
+				})
+			})
+		}
+	})
+
+	_, requests, bodies := daemon.received()
+	if len(requests) != 2*connections {
+		t.Fatalf("daemon received %d requests, expected %d", len(requests), 2*connections)
+	}
+	for i, req := range requests {
+		if platform := req.URL.Query().Get("platform"); platform != "linux/arm64" {
+			t.Errorf("request %d for %s has platform '%s', expected linux/arm64", i, req.URL.Path, platform)
+		}
+		if req.URL.Path == "/v1.41/build" && string(bodies[i]) != body {
+			t.Errorf("request %d has a build body of %d bytes which doesn't match", i, len(bodies[i]))
+		}
+	}
+}
+
+func TestHandleConnectionKeepsHeaders(t *testing.T) {
+	// Base64url-encoded JSON, with the padding and characters a parser could trip on
+	auth := "eyJ1c2VybmFtZSI6InVzZXIiLCJwYXNzd29yZCI6InA0c3M_dzByZC8rPSIsInNlcnZlcmFkZHJlc3MiOiJnaGNyLmlvIn0="
+	headers := "Host: docker\r\nX-Registry-Auth: " + auth + "\r\nContent-Type: text/plain\r\n\r\n"
+	tests := []struct {
+		name     string
+		line     string
+		injected string
+	}{
+		{
+			name:     "fast path",
+			line:     "POST /v1.41/images/create?fromImage=ghcr.io%2Fowner%2Fimage&tag=1 HTTP/1.1\r\n",
+			injected: "POST /v1.41/images/create?fromImage=ghcr.io%2Fowner%2Fimage&tag=1&platform=linux%2Farm64 HTTP/1.1\r\n",
+		},
+		{
+			name:     "slow path",
+			line:     "POST /v1.41/images/create?platform=linux%2Famd64&fromImage=ghcr.io%2Fowner%2Fimage&tag=1 HTTP/1.1\r\n",
+			injected: "POST /v1.41/images/create?fromImage=ghcr.io%2Fowner%2Fimage&platform=linux%2Farm64&tag=1 HTTP/1.1\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		daemon := &fakeDaemon{}
+		proxyRequests(t, testOptions(daemon), test.line+headers)
+
+		raw, requests, _ := daemon.received()
+		if raw != test.injected+headers {
+			t.Errorf("%s: daemon received %q, expected %q", test.name, raw, test.injected+headers)
+		}
+		if len(requests) == 1 && requests[0].Header.Get("X-Registry-Auth") != auth {
+			t.Errorf("%s: got credentials %q", test.name, requests[0].Header.Get("X-Registry-Auth"))
+		}
+	}
+}
+
+func TestInjectPlatformKeepsImageCreateParameters(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"fromImage and tag", "fromImage=alpine&tag=3.18"},
+		{"fromImage with a digest", "fromImage=alpine&tag=sha256%3A0123"},
+		{"fromSrc", "fromSrc=-&repo=imported&tag=1&message=from+a+tarball"},
+		{"fromSrc URL", "fromSrc=https%3A%2F%2Fexample.com%2Frootfs.tar&repo=imported&changes=ENV+A%3D1&changes=CMD+%5B%22sh%22%5D"},
+		{"everything", "fromImage=alpine&fromSrc=-&repo=imported&tag=1&message=m&changes=CMD+sh"},
+	}
+
+	for _, test := range tests {
+		expected, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected.Set("platform", "linux/arm64")
+		// Without and with a platform to replace, to go through both injection paths
+		for _, query := range []string{test.query, test.query + "&platform=linux%2Famd64"} {
+			injected, err := injectPlatform([]byte("POST /v1.41/images/create?"+query+" HTTP/1.1\r"), "platform", "linux/arm64")
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			got, err := requestQuery(injected)
+			if err != nil || !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: got %q and error %v, expected %v", test.name, injected, err, expected)
+			}
+		}
+	}
+}
+
+func TestHandleConnectionGrowingInjectionAcrossFragments(t *testing.T) {
+	line := "POST /v1.41/images/create?fromImage=alpine&tag=3.18 HTTP/1.1\r\n"
+	injected := "POST /v1.41/images/create?fromImage=alpine&tag=3.18&platform=linux%2Farm64 HTTP/1.1\r\n"
+	body := `{"note":"the body follows the headers right away"}`
+	rest := fmt.Sprintf("Host: docker\r\nX-Registry-Auth: e30=\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+
+	for _, fragmentSize := range []int{1, 3, 7, 50, len(line) + 5} {
+		daemon := &fakeDaemon{}
+		proxyConnection(t, testOptions(daemon), func(client net.Conn, reader *bufio.Reader) {
+			go func() {
+				// Each write is read separately
+				data := []byte(line + rest)
+				for len(data) > 0 {
+					n := fragmentSize
+					if n > len(data) {
+						n = len(data)
+					}
+					if _, err := client.Write(data[:n]); err != nil {
+						return
+					}
+					data = data[n:]
+				}
+			}()
+			readResponse(t, reader)
+		})
+
+		raw, _, bodies := daemon.received()
+		if raw != injected+rest {
+			t.Errorf("in fragments of %d: daemon received %q, expected %q", fragmentSize, raw, injected+rest)
+		}
+		if len(bodies) != 1 || string(bodies[0]) != body {
+			t.Errorf("in fragments of %d: got bodies %q", fragmentSize, bodies)
+		}
+	}
+}
+
+func TestForwardAllRelaysPullProgress(t *testing.T) {
+	var chunks []string
+	for i := 0; i < 500; i++ {
+		chunks = append(chunks, fmt.Sprintf(`{"status":"Downloading","progressDetail":{"current":%d,"total":500},"id":"4abcf2066143"}`+"\r\n", i))
+	}
+	chunks = append(chunks, `{"status":"Digest: sha256:0123"}`+"\r\n", `{"status":"Status: Downloaded newer image for alpine:latest"}`+"\r\n")
+	head := "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n"
+	var stream strings.Builder
+	for _, chunk := range chunks {
+		fmt.Fprintf(&stream, "%x\r\n%s\r\n", len(chunk), chunk)
+	}
+	stream.WriteString("0\r\n\r\n")
+	first := fmt.Sprintf("%x\r\n%s\r\n", len(chunks[0]), chunks[0])
+	response := head + stream.String()
+
+	// The rest of the progress only comes once the client got the beginning of it, like with a slow download
+	firstReceived := make(chan struct{})
+	opts := testOptions(&fakeDaemon{})
+	opts.dial = func(context.Context) (net.Conn, error) {
+		proxySide, daemonSide, err := socketPair()
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			defer daemonSide.Close()
+			if _, err := http.ReadRequest(bufio.NewReader(daemonSide)); err != nil {
+				return
+			}
+			if _, err := daemonSide.Write([]byte(head + first)); err != nil {
+				return
+			}
+			select {
+			case <-firstReceived:
+			case <-time.After(5 * time.Second):
+				return
+			}
+			_, _ = daemonSide.Write([]byte(response[len(head+first):]))
+		}()
+		return proxySide, nil
+	}
+
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		if _, err := client.Write([]byte("POST /v1.41/images/create?fromImage=alpine&tag=latest HTTP/1.1\r\nHost: docker\r\n\r\n")); err != nil {
+			t.Fatal("unable to send request:", err)
+		}
+		received := make([]byte, len(response))
+		if _, err := io.ReadFull(reader, received[:len(head+first)]); err != nil {
+			t.Fatal("the beginning of the progress wasn't relayed on its own:", err)
+		}
+		close(firstReceived)
+		if _, err := io.ReadFull(reader, received[len(head+first):]); err != nil {
+			t.Fatal("unable to read the progress:", err)
+		}
+		if string(received) != response {
+			t.Error("the progress stream was altered")
+		}
+
+		// And it still decodes to the same messages, the final status included
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(received)), nil)
+		if err != nil {
+			t.Fatal("unable to parse the response:", err)
+		}
+		decoded, err := ioutil.ReadAll(resp.Body)
+		if err != nil || string(decoded) != strings.Join(chunks, "") {
+			t.Errorf("got %d bytes of progress and error %v", len(decoded), err)
+		}
+	})
+}
+
+func TestHandleConnectionTagsOverOneDaemonConnection(t *testing.T) {
+	daemon := &fakeDaemon{reply: func(_ int, req *http.Request) (string, bool) {
+		if strings.HasSuffix(req.URL.Path, "/tag") {
+			return "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n", false
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false
+	}}
+	opts := testOptions(daemon)
+	opts.defaultRegistry = "mirror.local"
+	pull := "POST /v1.41/images/create?fromImage=alpine&tag=%d HTTP/1.1\r\nHost: docker\r\n\r\n"
+	proxyRequests(t, opts, fmt.Sprintf(pull, 1), fmt.Sprintf(pull, 2), fmt.Sprintf(pull, 3))
+
+	_, requests, _ := daemon.received()
+	tags := 0
+	for _, req := range requests {
+		if strings.HasSuffix(req.URL.Path, "/tag") {
+			tags++
+		}
+	}
+	if tags != 3 {
+		t.Errorf("the daemon got %d tag requests, expected 3", tags)
+	}
+	// The client's connection, and a single one shared by the tag requests
+	if dials := atomic.LoadInt32(&daemon.dials); dials != 2 {
+		t.Errorf("the daemon was dialed %d times, expected twice", dials)
+	}
+}
+
+func TestHandleConnectionRunSequence(t *testing.T) {
+	daemon := &fakeDaemon{}
+	opts := testOptions(daemon)
+	// As with -rewrite-containers-create
+	opts.endpoints = []*endpoint{imagesCreate, containersCreate}
+	config := `{"Image":"alpine","Cmd":["true"]}`
+	proxyRequests(t, opts,
+		"POST /v1.41/images/create?fromImage=alpine&tag=latest HTTP/1.1\r\nHost: docker\r\n\r\n",
+		fmt.Sprintf("POST /v1.41/containers/create?name=app HTTP/1.1\r\nHost: docker\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(config), config))
+
+	_, requests, bodies := daemon.received()
+	if len(requests) != 2 {
+		t.Fatalf("daemon received %d requests, expected 2", len(requests))
+	}
+	for i, path := range []string{"/v1.41/images/create", "/v1.41/containers/create"} {
+		if requests[i].URL.Path != path || requests[i].URL.Query().Get("platform") != "linux/arm64" {
+			t.Errorf("request %d is %s, expected %s with platform linux/arm64", i, requests[i].URL, path)
+		}
+	}
+	if requests[1].URL.Query().Get("name") != "app" || string(bodies[1]) != config {
+		t.Errorf("the container creation changed: %s with body %q", requests[1].URL, bodies[1])
+	}
+}
+
+// Read an error response sent by the proxy, returning its status code and
+// message
+func readErrorResponse(t *testing.T, reader *bufio.Reader) (int, string) {
+	t.Helper()
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal("unable to read response:", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal("unable to decode error response:", err)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" || !resp.Close {
+		t.Errorf("error response has headers %v", resp.Header)
+	}
+	return resp.StatusCode, body.Message
+}
+
+func TestErrorResponse(t *testing.T) {
+	message := `docker-platformify: "quoted" and
+multi-line`
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(errorResponse(http.StatusBadGateway, message))), nil)
+	if err != nil {
+		t.Fatal("unable to parse error response:", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The shape of the errors returned by the Docker daemon, which the CLI shows as is
+	var decoded map[string]string
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("body %q isn't JSON: %v", body, err)
+	}
+	if len(decoded) != 1 || decoded["message"] != message {
+		t.Errorf("got body %q, expected only the message", body)
+	}
+	if resp.StatusCode != http.StatusBadGateway || resp.ContentLength != int64(len(body)) {
+		t.Errorf("got status %d and length %d for a %d bytes body", resp.StatusCode, resp.ContentLength, len(body))
+	}
+}
+
+func TestHandleConnectionReportsUnreachableDaemon(t *testing.T) {
+	opts := testOptions(&fakeDaemon{})
+	opts.dial = func(context.Context) (net.Conn, error) {
+		return nil, syscall.ECONNREFUSED
+	}
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		if status, message := readErrorResponse(t, reader); status != http.StatusBadGateway ||
+			message != "docker-platformify: unable to connect to the Docker daemon" {
+			t.Errorf("got %d '%s', expected 502", status, message)
+		}
+	})
+}
+
+func TestHandleConnectionFailClosed(t *testing.T) {
+	// Without an HTTP version, the request line can't be injected
+	request := "POST /v1.41/images/create?fromImage=alpine\r\nHost: docker\r\n\r\n"
+	for _, failClosed := range []bool{false, true} {
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.failClosed = failClosed
+		proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+			if _, err := client.Write([]byte(request)); err != nil {
+				t.Fatal("unable to send request:", err)
+			}
+			if !failClosed {
+				// The daemon gets the request as is, and hangs up on it
+				_, _ = io.Copy(ioutil.Discard, reader)
+				return
+			}
+			if status, message := readErrorResponse(t, reader); status != http.StatusInternalServerError ||
+				message != "docker-platformify: unable to inject platform into request" {
+				t.Errorf("got %d '%s', expected 500", status, message)
+			}
+			if _, err := reader.ReadByte(); err != io.EOF {
+				t.Errorf("connection wasn't closed after the error: %v", err)
+			}
+		})
+
+		raw, _, _ := daemon.received()
+		if failClosed && len(raw) != 0 {
+			t.Errorf("the daemon received the rejected request: %q", raw)
+		} else if !failClosed && string(raw) != request {
+			t.Errorf("the daemon received %q, expected the request as is", raw)
+		}
+	}
+}
+
+func TestHandleConnectionRequireDigest(t *testing.T) {
+	daemon := &fakeDaemon{}
+	opts := testOptions(daemon)
+	opts.requireDigest = true
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	statuses := proxyRequests(t, opts,
+		"POST /v1.41/images/create?fromImage=alpine&tag="+digest+" HTTP/1.1\r\nHost: docker\r\n\r\n",
+		"POST /v1.41/images/create?fromImage=alpine&tag=latest HTTP/1.1\r\nHost: docker\r\n\r\n")
+	if !reflect.DeepEqual(statuses, []int{http.StatusOK, http.StatusForbidden}) {
+		t.Errorf("got statuses %v, expected 200 then 403", statuses)
+	}
+	_, requests, _ := daemon.received()
+	if len(requests) != 1 || requests[0].URL.Query().Get("tag") != digest ||
+		requests[0].URL.Query().Get("platform") != "linux/arm64" {
+		t.Errorf("daemon received %v, expected the digest pull only", requests)
+	}
+}
+
+func TestHandleConnectionRejectsAfterPreviousResponses(t *testing.T) {
+	daemon := &fakeDaemon{reply: func(int, *http.Request) (string, bool) {
+		// The rejection must wait for the response
+		time.Sleep(100 * time.Millisecond)
+		return "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 15\r\n\r\n{\"Version\":\"1\"}", false
+	}}
+	opts := testOptions(daemon)
+	opts.requireDigest = true
+
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		// Pipelined, the rejected request is looked at before the daemon answers the first one
+		if _, err := client.Write([]byte("GET /v1.41/version HTTP/1.1\r\nHost: docker\r\n\r\n" +
+			"POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\n\r\n")); err != nil {
+			t.Fatal("unable to send requests:", err)
+		}
+		if status := readResponse(t, reader); status != http.StatusOK {
+			t.Errorf("first response has status %d, expected 200", status)
+		}
+		if status, _ := readErrorResponse(t, reader); status != http.StatusForbidden {
+			t.Errorf("second response has status %d, expected 403", status)
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Errorf("connection wasn't closed after the error: %v", err)
+		}
+	})
+}
+
+func TestHandleConnectionClientHangsUp(t *testing.T) {
+	logs := recordLogs(t, logging.INFO)
+	daemon := &fakeDaemon{}
+	// Whether the daemon side notices while reading or in between reads depends on timing
+	for i := 0; i < 20; i++ {
+		proxyConnection(t, testOptions(daemon), func(client net.Conn, reader *bufio.Reader) {
+			if _, err := client.Write([]byte("POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\n\r\n")); err != nil {
+				t.Fatal("unable to send request:", err)
+			}
+			readResponse(t, reader)
+			time.Sleep(time.Duration(i) * 5 * time.Millisecond)
+		})
+	}
+
+	if messages := logs.messages(logging.WARNING, ""); len(messages) > 0 {
+		t.Errorf("a client hanging up after its requests was logged as %q", messages)
+	}
+	if closed := logs.messages(logging.INFO, "closed client -> docker"); len(closed) != 20 {
+		t.Errorf("logged %d connections closed by the client, expected 20", len(closed))
+	}
+}
+
+func TestHandleConnectionUpstreamWriteTimeout(t *testing.T) {
+	logs := recordLogs(t, logging.ERROR)
+	opts := testOptions(nil)
+	opts.upstreamWriteTimeout = 100 * time.Millisecond
+	// A daemon that accepts the connection, then never reads from it
+	opts.dial = func(context.Context) (net.Conn, error) {
+		proxySide, daemonSide, err := socketPair()
+		if err == nil {
+			t.Cleanup(func() { _ = daemonSide.Close() })
+		}
+		return proxySide, err
+	}
+
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		// Way more than fits in the socket buffers
+		go func() {
+			_, _ = fmt.Fprintf(client, "POST /v1.41/build HTTP/1.1\r\nHost: docker\r\nContent-Length: %d\r\n\r\n", 64<<20)
+			chunk := make([]byte, 64<<10)
+			for i := 0; i < 1024; i++ {
+				if _, err := client.Write(chunk); err != nil {
+					return
+				}
+			}
+		}()
+		// Torn down long before the client's deadline
+		started := time.Now()
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Errorf("got %v reading from the proxy, expected it to hang up", err)
+		}
+		if elapsed := time.Since(started); elapsed > 2*time.Second {
+			t.Errorf("took %s to give up on the daemon", elapsed)
+		}
+	})
+
+	if !logs.contains(logging.ERROR, "timed out after 100ms writing to docker socket") {
+		t.Errorf("no write timeout logged: %q", logs.messages(logging.ERROR, ""))
+	}
+	if messages := logs.messages(logging.ERROR, "error while writing to docker socket"); len(messages) > 0 {
+		t.Errorf("the timeout was logged as a generic write error: %q", messages)
+	}
+}
+
+// A connection whose reads and writes are interrupted by a signal every other
+// time, with writes getting halfway first
+type interruptedConn struct {
+	net.Conn
+	reads, writes int32
+}
+
+func (c *interruptedConn) Read(b []byte) (int, error) {
+	if atomic.AddInt32(&c.reads, 1)%2 == 1 {
+		return 0, &net.OpError{Op: "read", Net: "unix", Err: os.NewSyscallError("read", syscall.EINTR)}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *interruptedConn) Write(b []byte) (int, error) {
+	if atomic.AddInt32(&c.writes, 1)%2 == 1 && len(b) > 1 {
+		n, err := c.Conn.Write(b[:len(b)/2])
+		if err == nil {
+			err = &net.OpError{Op: "write", Net: "unix", Err: os.NewSyscallError("write", syscall.EINTR)}
+		}
+		return n, err
+	}
+	return c.Conn.Write(b)
+}
+
+func TestHandleConnectionRetriesInterruptedCalls(t *testing.T) {
+	logs := recordLogs(t, logging.WARNING)
+	daemon := &fakeDaemon{}
+	opts := testOptions(daemon)
+	opts.dial = func(ctx context.Context) (net.Conn, error) {
+		conn, err := daemon.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &interruptedConn{Conn: conn}, nil
+	}
+
+	client, proxied := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(&interruptedConn{Conn: proxied}, opts)
+		close(done)
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	for i := 0; i < 3; i++ {
+		if _, err := fmt.Fprint(client, "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"); err != nil {
+			t.Fatal("unable to send request:", err)
+		}
+		if status := readResponse(t, reader); status != http.StatusOK {
+			t.Fatalf("got status %d", status)
+		}
+	}
+	_ = client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("the connection wasn't closed")
+	}
+
+	_, requests, _ := daemon.received()
+	if len(requests) != 3 {
+		t.Fatalf("daemon received %d requests, expected 3", len(requests))
+	}
+	for _, req := range requests {
+		if platform := req.URL.Query().Get("platform"); platform != "linux/arm64" {
+			t.Errorf("got platform %q", platform)
+		}
+	}
+	if messages := logs.messages(logging.WARNING, ""); len(messages) > 0 {
+		t.Errorf("interrupted calls were logged as %q", messages)
+	}
+}
+
+func TestHandleConnectionMaxLifetime(t *testing.T) {
+	logs := recordLogs(t, logging.INFO)
+	opts := testOptions(nil)
+	opts.maxConnectionLifetime = 300 * time.Millisecond
+	// A daemon streaming events until the connection is closed
+	opts.dial = func(context.Context) (net.Conn, error) {
+		proxySide, daemonSide, err := socketPair()
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			defer daemonSide.Close()
+			if _, err := http.ReadRequest(bufio.NewReader(daemonSide)); err != nil {
+				return
+			}
+			_, err := io.WriteString(daemonSide, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n")
+			for ; err == nil; time.Sleep(10 * time.Millisecond) {
+				_, err = io.WriteString(daemonSide, "2\r\n{}\r\n")
+			}
+		}()
+		return proxySide, nil
+	}
+
+	started := time.Now()
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		if _, err := io.WriteString(client, "GET /v1.41/events HTTP/1.1\r\nHost: docker\r\n\r\n"); err != nil {
+			t.Fatal("unable to send request:", err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal("unable to read response:", err)
+		}
+		// Events keep coming until the connection is closed
+		events, err := io.Copy(ioutil.Discard, resp.Body)
+		if err != io.ErrUnexpectedEOF || events < 10 {
+			t.Errorf("got %d bytes of events and %v, expected the stream to be cut", events, err)
+		}
+	})
+	if elapsed := time.Since(started); elapsed < opts.maxConnectionLifetime || elapsed > 2*time.Second {
+		t.Errorf("the stream was closed after %s, expected %s", elapsed, opts.maxConnectionLifetime)
+	}
+	if !logs.contains(logging.INFO, "open for longer than 300ms") {
+		t.Errorf("closing the connection wasn't logged: %q", logs.messages(logging.INFO, "closed connection"))
+	}
+}
+
+func TestHandleConnectionRewritesExtraMethods(t *testing.T) {
+	requests := []string{
+		"PUT /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n",
+		"DELETE /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\n\r\n",
+		"POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n",
+	}
+	for _, extraMethods := range [][]string{nil, {"PUT"}} {
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.extraMethods = extraMethods
+		proxyRequests(t, opts, requests...)
+
+		_, received, _ := daemon.received()
+		if len(received) != len(requests) {
+			t.Fatalf("daemon received %d requests, expected %d", len(received), len(requests))
+		}
+		injected := map[string]bool{}
+		for _, req := range received {
+			injected[req.Method] = req.URL.Query().Get("platform") == "linux/arm64"
+		}
+		if expected := extraMethods != nil; injected["PUT"] != expected {
+			t.Errorf("extra methods %v: PUT injected: %t", extraMethods, injected["PUT"])
+		}
+		if injected["DELETE"] || !injected["POST"] {
+			t.Errorf("extra methods %v: DELETE injected: %t, POST injected: %t", extraMethods, injected["DELETE"], injected["POST"])
+		}
+	}
+
+	config := printedConfig(t, nil, "-rewrite-methods", " put, Patch ,", "/run/docker.sock", "/run/platformify.sock", "linux/arm64")
+	if methods := fmt.Sprint(config["rewrite-methods"]); methods != "[PUT PATCH]" {
+		t.Errorf("got rewrite methods %s, expected [PUT PATCH]", methods)
+	}
+}
+
+func TestHandleConnectionExpectContinue(t *testing.T) {
+	opts := testOptions(&fakeDaemon{})
+	// The request line the daemon received, and the body sent after "100 Continue"
+	received := make(chan string, 2)
+	opts.dial = func(context.Context) (net.Conn, error) {
+		proxySide, daemonSide, err := socketPair()
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			defer daemonSide.Close()
+			reader := bufio.NewReader(daemonSide)
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			received <- req.Method + " " + req.URL.String()
+			_, _ = fmt.Fprint(daemonSide, "HTTP/1.1 100 Continue\r\n\r\n")
+			body, _ := ioutil.ReadAll(req.Body)
+			received <- string(body)
+			_, _ = fmt.Fprint(daemonSide, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+		}()
+		return proxySide, nil
+	}
+
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := fmt.Fprint(client, "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\n"+
+			"Expect: 100-continue\r\nContent-Length: 4\r\n\r\n"); err != nil {
+			t.Fatal("unable to send request:", err)
+		}
+		// The body is only sent once the daemon asked for it
+		if status := readResponse(t, reader); status != http.StatusContinue {
+			t.Fatalf("got status %d, expected 100", status)
+		}
+		if _, err := fmt.Fprint(client, "body"); err != nil {
+			t.Fatal("unable to send body:", err)
+		}
+		if status := readResponse(t, reader); status != http.StatusOK {
+			t.Errorf("got status %d, expected 200", status)
+		}
+	})
+
+	if line := <-received; line != "POST /v1.41/images/create?fromImage=alpine&platform=linux%2Farm64" {
+		t.Errorf("daemon received %s", line)
+	}
+	if body := <-received; body != "body" {
+		t.Errorf("daemon received body %q", body)
+	}
+}
+
+func TestProxySocketRemovedOnExit(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock, proxySock := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "proxy.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	proxy, log := startProxy(t, nil, "-no-banner", dockerSock, proxySock, "linux/arm64")
+	log.waitFor(t, "listening on")
+	if status := requestUnix(t, proxySock, "GET", "/_ping"); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if err := proxy.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Wait(); err != nil {
+		t.Errorf("the proxy exited with %v", err)
+	}
+	if _, err := os.Stat(proxySock); !os.IsNotExist(err) {
+		t.Errorf("proxy socket left behind after shutdown: %v", err)
+	}
+
+	// Failing after binding the socket, because the PID file belongs to the test
+	pidFile := filepath.Join(dir, "platformify.pid")
+	if err := ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, stderr, code := runMain(t, nil, "-pidfile", pidFile, dockerSock, proxySock, "linux/arm64"); code == 0 ||
+		!strings.Contains(stderr, "listening on") {
+		t.Fatalf("exited with code %d after binding the socket: %s", code, stderr)
+	}
+	if _, err := os.Stat(proxySock); !os.IsNotExist(err) {
+		t.Errorf("proxy socket left behind after failing: %v", err)
+	}
+}
+
+func TestNoBanner(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock := filepath.Join(dir, "docker.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, noBanner := range []bool{false, true} {
+		proxySock := filepath.Join(dir, fmt.Sprintf("%t.sock", noBanner))
+		args := []string{dockerSock, proxySock, "linux/arm64"}
+		if noBanner {
+			args = append([]string{"-no-banner"}, args...)
+		}
+		cmd := mainCommand(t, nil, args...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal("unable to start the proxy:", err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(proxySock); err == nil {
+				break
+			}
+		}
+		requestUnix(t, proxySock, "GET", "/_ping")
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("the proxy exited with %v: %s", err, stderr.String())
+		}
+
+		if printed := strings.Contains(stdout.String(), "Copyright"); printed == noBanner {
+			t.Errorf("-no-banner=%t: banner printed: %t", noBanner, printed)
+		}
+		startup := fmt.Sprintf("startup listen=%q upstream=%q platform=%q version=%q",
+			"unix://"+proxySock, "unix://"+dockerSock, "linux/arm64", version)
+		if logged := strings.Contains(stderr.String(), startup); logged != noBanner {
+			t.Errorf("-no-banner=%t: startup line logged: %t\n%s", noBanner, logged, stderr.String())
+		}
+	}
+}
+
+func TestHandleConnectionRelaysEverythingBeforeDaemonHangsUp(t *testing.T) {
+	// Delimited by the end of the connection, and larger than a single read
+	body := strings.Repeat("0123456789abcdef", 10000)
+	daemon := &fakeDaemon{reply: func(int, *http.Request) (string, bool) {
+		return "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n" + body, true
+	}}
+	proxyConnection(t, testOptions(daemon), func(client net.Conn, reader *bufio.Reader) {
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := fmt.Fprint(client, "GET /v1.41/images/get HTTP/1.1\r\nHost: docker\r\n\r\n"); err != nil {
+			t.Fatal("unable to send request:", err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal("unable to read response:", err)
+		}
+		received, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil || string(received) != body {
+			t.Errorf("received %d of %d bytes of the body, error %v", len(received), len(body), err)
+		}
+	})
+}
+
+func TestHandleConnectionPassesHTTP2Through(t *testing.T) {
+	logs := recordLogs(t, logging.WARNING)
+	// Request-like bytes after the preface mustn't be mistaken for a request line
+	sent := string(http2Preface) + "\x00\x00\x00\x04\x00\x00\x00\x00\x00" +
+		"POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\n\r\n"
+	opts := testOptions(&fakeDaemon{})
+	received := make(chan string, 1)
+	opts.dial = func(context.Context) (net.Conn, error) {
+		proxySide, daemonSide, err := socketPair()
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			defer daemonSide.Close()
+			data := make([]byte, len(sent))
+			_ = daemonSide.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _ := io.ReadFull(daemonSide, data)
+			received <- string(data[:n])
+		}()
+		return proxySide, nil
+	}
+
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		// The preface is recognized even when it arrives in pieces
+		for _, part := range []string{sent[:5], sent[5:]} {
+			if _, err := client.Write([]byte(part)); err != nil {
+				t.Fatal("unable to send data:", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if data := <-received; data != sent {
+			t.Errorf("daemon received %q, expected %q", data, sent)
+		}
+	})
+	if !logs.contains(logging.WARNING, "client is speaking HTTP/2") {
+		t.Errorf("no warning about HTTP/2 was logged; logged %q", logs.messages(logging.WARNING, ""))
+	}
+}
+
+func TestHandleConnectionDefaultPlatformMode(t *testing.T) {
+	requests := []string{
+		"POST /v1.41/images/create?fromImage=alpine&platform=linux%2Fs390x HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n",
+		"POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n",
+		// Empty, as sent by the CLI when --platform isn't given
+		"POST /v1.41/images/create?fromImage=alpine&platform= HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n",
+	}
+	tests := []struct {
+		mode      string
+		platforms []string
+	}{
+		{"replace", []string{"linux/arm64", "linux/arm64", "linux/arm64"}},
+		{"default", []string{"linux/s390x", "linux/arm64", "linux/arm64"}},
+	}
+	for _, test := range tests {
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.platformMode = test.mode
+		proxyRequests(t, opts, requests...)
+
+		_, received, _ := daemon.received()
+		var platforms []string
+		for _, req := range received {
+			platforms = append(platforms, req.URL.Query().Get("platform"))
+		}
+		if !reflect.DeepEqual(platforms, test.platforms) {
+			t.Errorf("%s mode: daemon received platforms %q, expected %q", test.mode, platforms, test.platforms)
+		}
+	}
+}
+
+func TestHandleConnectionNoticesReplacedPlatform(t *testing.T) {
+	pull := func(platform string) string {
+		return "POST /v1.41/images/create?fromImage=alpine&platform=" + platform + " HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	}
+	tests := []struct {
+		mode     string
+		platform string
+		noticed  bool
+	}{
+		{"replace", "linux%2Famd64", true},
+		// Asking for the configured platform, or none, isn't overridden
+		{"replace", "linux%2Farm64", false},
+		{"replace", "Linux%2FARM64", false},
+		{"replace", "", false},
+		{"default", "linux%2Famd64", false},
+	}
+	for _, test := range tests {
+		logs := recordLogs(t, logging.NOTICE)
+		opts := testOptions(&fakeDaemon{})
+		opts.platformMode = test.mode
+		proxyRequests(t, opts, pull(test.platform))
+
+		notices := logs.messages(logging.NOTICE, "asked for platform")
+		if !test.noticed && len(notices) > 0 {
+			t.Errorf("%s mode, platform %q: unexpected notice %q", test.mode, test.platform, notices)
+		} else if test.noticed && (len(notices) != 1 || notices[0] !=
+			"'docker image create/pull' command asked for platform linux/amd64, replacing it with linux/arm64") {
+			t.Errorf("%s mode, platform %q: got notices %q", test.mode, test.platform, notices)
+		}
+	}
+}
+
+func TestEnsureSocketDoesNotExist(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.sock")
+	// A socket left behind by a proxy that didn't clean up
+	staleSocket := func() {
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		_ = ln.Close()
+	}
+
+	for _, quiet := range []bool{false, true} {
+		logs := recordLogs(t, logging.INFO)
+		staleSocket()
+		if err := ensureSocketDoesNotExist(path, quiet); err != nil {
+			t.Fatal("stale socket not removed:", err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("stale socket still there: %v", err)
+		}
+		if logged := logs.contains(logging.INFO, "removed old proxy socket"); logged == quiet {
+			t.Errorf("quiet: %t: removal logged at INFO: %t", quiet, logged)
+		}
+	}
+
+	// Anything else is left alone, quiet or not
+	if err := ioutil.WriteFile(path, []byte("important"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := ensureSocketDoesNotExist(path, true)
+	if exitErr, ok := err.(*exitError); !ok || exitErr.code != exitSocketInUse {
+		t.Errorf("got error %v for a regular file, expected the socket to be in use", err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "important" {
+		t.Error("the regular file was modified")
+	}
+}
+
+func TestHandleConnectionSkipsImports(t *testing.T) {
+	imports := "POST /v1.41/images/create?fromSrc=-&repo=app&tag=1 HTTP/1.1\r\nHost: docker\r\nContent-Length: 4\r\n\r\ntar!"
+	for _, rewriteImports := range []bool{false, true} {
+		logs := recordLogs(t, logging.INFO)
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.rewriteImports = rewriteImports
+		proxyRequests(t, opts, imports)
+
+		_, requests, bodies := daemon.received()
+		if len(requests) != 1 || string(bodies[0]) != "tar!" {
+			t.Fatalf("daemon received %d requests, bodies %q", len(requests), bodies)
+		}
+		expected := ""
+		if rewriteImports {
+			expected = "linux/arm64"
+		}
+		if platform := requests[0].URL.Query().Get("platform"); platform != expected {
+			t.Errorf("rewrite imports: %t: got platform %q, expected %q", rewriteImports, platform, expected)
+		}
+		if skipped := logs.contains(logging.INFO, "image import doesn't pull anything"); skipped == rewriteImports {
+			t.Errorf("rewrite imports: %t: skipped import logged: %t", rewriteImports, skipped)
+		}
+	}
+}
+
+func TestHandleConnectionFirstPullOnly(t *testing.T) {
+	pull := func(image string) string {
+		return "POST /v1.41/images/create?fromImage=" + image + " HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	}
+	for _, firstPullOnly := range []bool{false, true} {
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.firstPullOnly = firstPullOnly
+		// Other requests don't count as pulls
+		proxyRequests(t, opts, "GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n", pull("probe"), pull("app"), pull("sidecar"))
+		// Each connection gets its first pull rewritten
+		proxyRequests(t, opts, pull("other"))
+
+		_, requests, _ := daemon.received()
+		if len(requests) != 5 {
+			t.Fatalf("daemon received %d requests, expected 5", len(requests))
+		}
+		for i, req := range requests[1:] {
+			expected := "linux/arm64"
+			if firstPullOnly && (i == 1 || i == 2) {
+				expected = ""
+			}
+			if platform := req.URL.Query().Get("platform"); platform != expected {
+				t.Errorf("first pull only: %t: got platform %q for %s, expected %q",
+					firstPullOnly, platform, req.URL.Query().Get("fromImage"), expected)
+			}
+		}
+	}
+}
+
+func TestHandleConnectionPartialLineGrace(t *testing.T) {
+	first, rest := "POST /v1.41/images/cr", "eate?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	tests := []struct {
+		grace    time.Duration
+		platform string
+	}{
+		// The rest of the line arrives within the grace period
+		{time.Second, "linux/arm64"},
+		// The beginning of the line is forwarded as is once the grace period is over
+		{50 * time.Millisecond, ""},
+	}
+	for _, test := range tests {
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.partialLineGrace = test.grace
+		proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+			if _, err := client.Write([]byte(first)); err != nil {
+				t.Fatal("unable to send request:", err)
+			}
+			time.Sleep(300 * time.Millisecond)
+			if _, err := client.Write([]byte(rest)); err != nil {
+				t.Fatal("unable to send request:", err)
+			}
+			readResponse(t, reader)
+		})
+
+		_, requests, _ := daemon.received()
+		if len(requests) != 1 {
+			t.Fatalf("grace %s: daemon received %d requests", test.grace, len(requests))
+		}
+		if platform := requests[0].URL.Query().Get("platform"); platform != test.platform {
+			t.Errorf("grace %s: got platform %q, expected %q", test.grace, platform, test.platform)
+		}
+	}
+}
+
+func TestHandleConnectionLogsGzipBodiesDecompressed(t *testing.T) {
+	logging.SetLevel(logging.DEBUG, "docker-platformify")
+	defer logging.SetLevel(logging.INFO, "docker-platformify")
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write([]byte(`{"Dockerfile":"FROM alpine"}`))
+	_ = writer.Close()
+	request := fmt.Sprintf("POST /v1.41/containers/create HTTP/1.1\r\nHost: docker\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s",
+		compressed.Len(), compressed.String())
+
+	for _, gunzip := range []bool{false, true} {
+		logs := recordLogs(t, logging.DEBUG)
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.debugGunzip = gunzip
+		proxyRequests(t, opts, request)
+
+		// Only the log shows the decompressed body
+		if _, _, bodies := daemon.received(); len(bodies) != 1 || !bytes.Equal(bodies[0], compressed.Bytes()) {
+			t.Errorf("gunzip: %t: the forwarded body was altered", gunzip)
+		}
+		if logged := logs.contains(logging.DEBUG, "(gzip body decompressed) POST /v1.41/containers/create") &&
+			logs.contains(logging.DEBUG, "\r\n\r\n"+`{"Dockerfile":"FROM alpine"}`); logged != gunzip {
+			t.Errorf("gunzip: %t: decompressed body logged: %t", gunzip, logged)
+		}
+	}
+}
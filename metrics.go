@@ -0,0 +1,118 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A Prometheus-style histogram with fixed buckets
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer, name string, help string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.buckets {
+		_, _ = fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	_, _ = fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// Time from receiving the first byte of a request to forwarding it injected
+var injectionLatency = newHistogram(.0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1)
+
+func writeMetric(w io.Writer, name string, kind string, help string, value int64) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "docker_platformify_active_connections", "gauge",
+		"Number of connections currently being proxied.", atomic.LoadInt64(&stats.activeConnections))
+	writeMetric(w, "docker_platformify_rejected_connections_total", "counter",
+		"Number of connections rejected because of the connection limit.", atomic.LoadInt64(&stats.rejectedConnections))
+	writeMetric(w, "docker_platformify_injections_total", "counter",
+		"Number of requests the platform was injected into.", atomic.LoadInt64(&stats.injections))
+	writeMetric(w, "docker_platformify_errors_total", "counter",
+		"Number of connection and injection errors.", atomic.LoadInt64(&stats.errors))
+	writeMetric(w, "docker_platformify_forwarded_bytes_total", "counter",
+		"Number of bytes forwarded in both directions.", atomic.LoadInt64(&stats.bytesForwarded))
+	injectionLatency.writeTo(w, "docker_platformify_injection_latency_seconds",
+		"Time from receiving the first byte of a request to forwarding it with the platform injected.")
+}
+
+// Serve Prometheus metrics over HTTP in the background, on either
+// "unix://<path>", "tcp://<address>" or a plain TCP address, along with the
+// samples at /samples unless they're nil; closing the returned listener stops
+// the server
+func serveMetrics(addr string, samples *sampleRing) (net.Listener, error) {
+	network, address := "tcp", addr
+	if strings.HasPrefix(addr, "unix://") {
+		network, address = "unix", strings.TrimPrefix(addr, "unix://")
+		if err := ensureSocketDoesNotExist(address, true); err != nil {
+			return nil, err
+		}
+	} else {
+		address = strings.TrimPrefix(addr, "tcp://")
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	if samples != nil {
+		mux.Handle("/samples", samples)
+	}
+	go func() {
+		if err := http.Serve(ln, mux); err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
+			log.Error("metrics server stopped:", err)
+		}
+	}()
+	return ln, nil
+}
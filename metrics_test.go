@@ -0,0 +1,130 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read a value off the metrics endpoint
+func scrapeMetric(t *testing.T, name string) float64 {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handleMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, name+" "), 64)
+			if err != nil {
+				t.Fatalf("invalid value for %s: %q", name, line)
+			}
+			return value
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+func TestInjectionLatency(t *testing.T) {
+	imagePlatformCache.mu.Lock()
+	imagePlatformCache.entries = make(map[platformCacheKey]platformCacheEntry)
+	imagePlatformCache.mu.Unlock()
+
+	// The first pull waits for a slow image lookup, the second one is answered
+	// from the cache
+	lookup := distributionDaemon()
+	daemon := &fakeDaemon{reply: func(n int, req *http.Request) (string, bool) {
+		if strings.HasPrefix(req.URL.Path, "/distribution/") {
+			time.Sleep(300 * time.Millisecond)
+			return lookup.reply(n, req)
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false
+	}}
+	opts := testOptions(daemon)
+	opts.platform = "linux/amd64"
+	opts.platformPreference = []string{"linux/arm64"}
+	opts.platformCacheTTL = time.Hour
+
+	const count = "docker_platformify_injection_latency_seconds_count"
+	const fast = `docker_platformify_injection_latency_seconds_bucket{le="0.1"}`
+	countBefore, fastBefore := scrapeMetric(t, count), scrapeMetric(t, fast)
+
+	pull := "POST /v1.41/images/create?fromImage=latency-image&tag=1 HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	proxyConnection(t, opts, func(client net.Conn, reader *bufio.Reader) {
+		if _, err := client.Write([]byte(pull + pull)); err != nil {
+			t.Fatal("unable to send requests:", err)
+		}
+		readResponse(t, reader)
+		readResponse(t, reader)
+	})
+
+	if observed := scrapeMetric(t, count) - countBefore; observed != 2 {
+		t.Fatalf("expected 2 latency observations, got %g", observed)
+	}
+	// The pipelined pull mustn't be charged for the lookup of the first one
+	if observed := scrapeMetric(t, fast) - fastBefore; observed != 1 {
+		t.Errorf("expected 1 observation under 100ms, got %g", observed)
+	}
+}
+
+func TestServeMetricsOnUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	// Left behind by a previous run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err := serveMetrics("unix://"+path, nil)
+	if err != nil {
+		t.Fatal("unable to serve metrics:", err)
+	}
+	defer ln.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://metrics/metrics")
+	if err != nil {
+		t.Fatal("unable to scrape metrics:", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "docker_platformify_active_connections ") {
+		t.Errorf("got status %d and metrics %q", resp.StatusCode, body)
+	}
+	// Samples weren't asked for
+	resp, err = client.Get("http://metrics/samples")
+	if err != nil {
+		t.Fatal("unable to get samples:", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for the samples", resp.StatusCode)
+	}
+}
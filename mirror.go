@@ -0,0 +1,74 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Split the tag out of an image reference without a digest, if it has one
+func splitTag(image string) (repository string, tag string) {
+	if colon := strings.LastIndexByte(image, ':'); colon > strings.LastIndexByte(image, '/') {
+		return image[:colon], image[colon+1:]
+	}
+	return image, ""
+}
+
+// Tag the image pulled by an image create request line rewritten by
+// setDefaultRegistry with the name the client asked for, so that e.g.
+// `docker run alpine` finds the image pulled by `docker pull alpine`. Digest
+// references can't be created this way, so images pulled by digest are only
+// known under the name of the default registry.
+func tagMirroredImage(opts *options, requestLine []byte, rewrittenLine []byte) {
+	query, err := requestQuery(requestLine)
+	if err != nil {
+		log.Warning("unable to tag image pulled from the default registry:", err)
+		return
+	}
+	rewrittenQuery, err := requestQuery(rewrittenLine)
+	if err != nil {
+		log.Warning("unable to tag image pulled from the default registry:", err)
+		return
+	}
+	pulled := pulledImage(rewrittenQuery)
+	repository, tag := splitTag(query.Get("fromImage"))
+	if query.Get("tag") != "" {
+		tag = query.Get("tag")
+	}
+	if tag == "" || strings.HasPrefix(tag, "sha256:") || strings.Contains(repository, "@") {
+		log.Infof("%s was pulled by digest or with all its tags, not tagging it as %s", pulled, repository)
+		return
+	}
+
+	client := &http.Client{Transport: opts.dockerTransport(), Timeout: 30 * time.Second}
+	params := url.Values{"repo": {repository}, "tag": {tag}}
+	resp, err := client.Post("http://docker/images/"+pulled+"/tag?"+params.Encode(), "", nil)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			err = fmt.Errorf("unexpected response: %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Warningf("unable to tag %s as %s:%s: %v", pulled, repository, tag, err)
+		return
+	}
+	log.Infof("tagged %s as %s:%s", pulled, repository, tag)
+}
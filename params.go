@@ -0,0 +1,71 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// A query parameter injected along with the platform
+type queryParam struct {
+	name  string
+	value string
+}
+
+// Flag collecting NAME=VALUE query parameters, in the order they are given
+type queryParamsFlag []queryParam
+
+func (f *queryParamsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	params := make([]string, 0, len(*f))
+	for _, param := range *f {
+		params = append(params, param.name+"="+param.value)
+	}
+	return strings.Join(params, ",")
+}
+
+func (f *queryParamsFlag) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i <= 0 {
+		return fmt.Errorf("'%s' is not in the NAME=VALUE format", value)
+	}
+	// Like the platform parameter, names are injected as they are
+	if name := value[:i]; url.QueryEscape(name) != name {
+		return fmt.Errorf("invalid parameter name '%s'", name)
+	}
+	*f = append(*f, queryParam{name: value[:i], value: value[i+1:]})
+	return nil
+}
+
+func (f *queryParamsFlag) Get() interface{} {
+	return f.String()
+}
+
+// Set the query parameters in a request line, replacing any values sent by the
+// client
+func injectParams(buffer []byte, params []queryParam) (injected []byte, err error) {
+	injected = buffer
+	for _, param := range params {
+		if injected, err = injectPlatform(injected, param.name, param.value); err != nil {
+			return nil, err
+		}
+	}
+	return injected, nil
+}
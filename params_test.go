@@ -0,0 +1,69 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQueryParamsFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"pull=always", true},
+		{"x-registry=my registry", true},
+		{"empty=", true},
+		{"=value", false},
+		{"novalue", false},
+		{"two words=x", false},
+		{"a&b=x", false},
+		{"a%20b=x", false},
+	}
+	for _, test := range tests {
+		var params queryParamsFlag
+		err := params.Set(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("Set(%q) returned %v, expected valid = %v", test.value, err, test.valid)
+		}
+		if test.valid && params.String() != test.value {
+			t.Errorf("Set(%q) collected %q", test.value, params.String())
+		}
+	}
+}
+
+func TestInjectParams(t *testing.T) {
+	params := queryParamsFlag{}
+	for _, value := range []string{"pull=always", "x-meta=a b"} {
+		if err := params.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	injected, err := injectParams([]byte("POST /images/create?fromImage=alpine&pull=never HTTP/1.1\r\n"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := string(injected)
+	for _, part := range []string{"fromImage=alpine", "pull=always", "x-meta=a+b"} {
+		if !strings.Contains(line, part) {
+			t.Errorf("%q doesn't contain %s", line, part)
+		}
+	}
+	if strings.Contains(line, "pull=never") {
+		t.Errorf("%q still has the client's value", line)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Most connections held while paused; more are rejected right away
+const maxHeldConnections = 128
+
+// Lets the accept loop be paused, e.g. for maintenance, while the connections
+// already accepted carry on. New connections are still accepted while paused,
+// but held until resuming, up to a limit and for a limited time, rather than
+// left to wait in the socket backlog for as long as the pause lasts.
+type acceptPauser struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	paused bool
+}
+
+// A connection accepted while paused, to be served once resumed
+type heldConn struct {
+	conn net.Conn
+	// When to give up and reject it
+	until time.Time
+}
+
+func newAcceptPauser(ln net.Listener) *acceptPauser {
+	return &acceptPauser{ln: ln}
+}
+
+func (p *acceptPauser) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Tell whether accepting is paused, and set the deadline of the next Accept:
+// expiry while paused, none otherwise. Both are done at once, so that pausing
+// or resuming right afterwards still wakes Accept up.
+func (p *acceptPauser) prepareAccept(expiry time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		p.setDeadline(expiry)
+	} else {
+		p.setDeadline(time.Time{})
+	}
+	return p.paused
+}
+
+// Stop serving new connections, returning false if already paused
+func (p *acceptPauser) pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return false
+	}
+	p.paused = true
+	// Wake up the pending Accept, which would otherwise serve one more connection
+	p.setDeadline(time.Now())
+	return true
+}
+
+// Serve new connections again, returning false if not paused
+func (p *acceptPauser) resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	// Wake up the pending Accept, so that the held connections are served
+	p.setDeadline(time.Now())
+	return true
+}
+
+func (p *acceptPauser) setDeadline(deadline time.Time) {
+	if ln, ok := p.ln.(interface{ SetDeadline(time.Time) error }); ok {
+		if err := ln.SetDeadline(deadline); err != nil {
+			log.Warning("unable to set proxy socket deadline:", err)
+		}
+	}
+}
+
+// Pause accepting connections on SIGTSTP and resume on SIGCONT. The signals
+// are caught before returning, so that SIGTSTP can't stop the process anymore.
+func pauseOnSignal(p *acceptPauser) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTSTP, syscall.SIGCONT)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGTSTP && p.pause() {
+				log.Noticef("paused accepting new connections, %d still active", activeConns.count())
+			} else if sig == syscall.SIGCONT && p.resume() {
+				log.Notice("resumed accepting new connections")
+			}
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock, proxySock := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "proxy.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	const pauseTimeout = 300 * time.Millisecond
+	proxy, log := startProxy(t, nil, "-no-banner", "-pause-timeout", pauseTimeout.String(), dockerSock, proxySock, "linux/arm64")
+	log.waitFor(t, "listening on")
+
+	if status := requestUnix(t, proxySock, "GET", "/_ping"); status != http.StatusOK {
+		t.Fatalf("got status %d before pausing", status)
+	}
+
+	if err := proxy.Process.Signal(syscall.SIGTSTP); err != nil {
+		t.Fatal(err)
+	}
+	log.waitFor(t, "paused accepting new connections")
+
+	// Held, then rejected once the pause timeout is over
+	started := time.Now()
+	if status := requestUnix(t, proxySock, "GET", "/_ping"); status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d while paused, expected 503", status)
+	}
+	if waited := time.Since(started); waited < pauseTimeout {
+		t.Errorf("rejected after %s, before the pause timeout", waited)
+	}
+	log.waitFor(t, "rejecting connection held for")
+
+	// Held, then served once resumed
+	conn, err := net.Dial("unix", proxySock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprint(conn, "GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	log.waitFor(t, "holding new connection while paused")
+	if err := proxy.Process.Signal(syscall.SIGCONT); err != nil {
+		t.Fatal(err)
+	}
+	if status := readResponse(t, bufio.NewReader(conn)); status != http.StatusOK {
+		t.Errorf("got status %d once resumed, expected 200", status)
+	}
+	log.waitFor(t, "serving 1 connections held while paused")
+
+	if status := requestUnix(t, proxySock, "GET", "/_ping"); status != http.StatusOK {
+		t.Errorf("got status %d after resuming", status)
+	}
+	if err := proxy.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Wait(); err != nil {
+		t.Errorf("the proxy exited with %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Credentials of the process on the other end of a Unix socket connection, as
+// of when it connected
+func peerCredentials(conn net.Conn) (*syscall.Ucred, error) {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("connection of type %T has no peer credentials", conn)
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, os.NewSyscallError("getsockopt SO_PEERCRED", credErr)
+	}
+	return cred, nil
+}
+
+// Path of the executable of the process on the other end of a Unix socket
+// connection
+func peerExecutable(conn net.Conn) (string, error) {
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(fmt.Sprintf("/proc/%d/exe", cred.Pid))
+}
+
+// Name and ID of the user running the process on the other end of a Unix
+// socket connection; just the ID if the name can't be resolved
+func peerUser(conn net.Conn) (string, error) {
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		return "", err
+	}
+	uid := strconv.FormatUint(uint64(cred.Uid), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		return fmt.Sprintf("%s (uid %s)", u.Username, uid), nil
+	}
+	return "uid " + uid, nil
+}
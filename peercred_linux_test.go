@@ -0,0 +1,92 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+// Send a pull through the proxy over a socket pair, so that the proxy sees the
+// test process as its client
+func pullOverSocketPair(t *testing.T, opts *options) {
+	t.Helper()
+	client, proxied, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		serveClient(proxied, opts)
+		close(done)
+	}()
+	if _, err := fmt.Fprint(client, "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"); err != nil {
+		t.Fatal("unable to send request:", err)
+	}
+	readResponse(t, bufio.NewReader(client))
+	_ = client.Close()
+	<-done
+}
+
+func TestClientExe(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		patterns []string
+		platform string
+	}{
+		{[]string{exe}, "linux/arm64"},
+		{[]string{"/usr/bin/docker", filepath.Join(filepath.Dir(exe), "*")}, "linux/arm64"},
+		{[]string{"/usr/bin/docker"}, ""},
+	}
+	for _, test := range tests {
+		daemon := &fakeDaemon{}
+		opts := testOptions(daemon)
+		opts.clientExes = test.patterns
+		pullOverSocketPair(t, opts)
+		_, requests, _ := daemon.received()
+		if len(requests) != 1 {
+			t.Fatalf("daemon received %d requests, expected 1", len(requests))
+		}
+		if platform := requests[0].URL.Query().Get("platform"); platform != test.platform {
+			t.Errorf("client executable patterns %q: got platform %q, expected %q", test.patterns, platform, test.platform)
+		}
+	}
+}
+
+func TestServeClientLogsUser(t *testing.T) {
+	logs := recordLogs(t, logging.INFO)
+	pullOverSocketPair(t, testOptions(&fakeDaemon{}))
+
+	expected := fmt.Sprintf("uid %d", os.Getuid())
+	if current, err := user.Current(); err == nil {
+		expected = fmt.Sprintf("%s (uid %d)", current.Username, os.Getuid())
+	}
+	if !logs.contains(logging.INFO, "new connection to proxy socket from "+expected) {
+		t.Errorf("no connection from %s logged: %q", expected, logs.messages(logging.INFO, "new connection"))
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWritePidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "platformify.pid")
+	// Left behind by a process that is no longer running
+	if err := ioutil.WriteFile(path, []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePidFile(path); err != nil {
+		t.Fatal("stale PID file not replaced:", err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("PID file holds %q", data)
+	}
+
+	// Belonging to a running process
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getppid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePidFile(path); err == nil || !strings.Contains(err.Error(), "belongs to running process") {
+		t.Errorf("got error %v for the PID file of a running process", err)
+	}
+}
+
+func TestPidFileRemovedOnShutdown(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock, proxySock, pidFile := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "proxy.sock"), filepath.Join(dir, "platformify.pid")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	proxy, log := startProxy(t, nil, "-no-banner", "-pidfile", pidFile, dockerSock, proxySock, "linux/arm64")
+	log.waitFor(t, "listening on")
+
+	// The PID file is written before serving
+	if status := requestUnix(t, proxySock, "GET", "/_ping"); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if data, err := ioutil.ReadFile(pidFile); err != nil || string(data) != fmt.Sprintf("%d\n", proxy.Process.Pid) {
+		t.Errorf("PID file holds %q, error %v, expected %d", data, err, proxy.Process.Pid)
+	}
+
+	if err := proxy.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Wait(); err != nil {
+		t.Errorf("the proxy exited with %v", err)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("PID file left behind after shutdown: %v", err)
+	}
+}
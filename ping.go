@@ -0,0 +1,66 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Implementation of the "ping" subcommand: check that the proxy, and the daemon
+// behind it, answer to "GET /_ping". Returns the process exit code.
+func ping(args []string) int {
+	flags := flag.NewFlagSet("ping", flag.ExitOnError)
+	sock := flags.String("sock", "", "path to the proxied socket")
+	timeout := flags.Duration("timeout", 5*time.Second, "time to wait for a response")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s ping -sock <proxied socket> [-timeout duration]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if *sock == "" {
+		flags.Usage()
+		return 2
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", *sock)
+			},
+		},
+		Timeout: *timeout,
+	}
+	resp, err := client.Get("http://docker/_ping")
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "ping failed:", err)
+		return 1
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = fmt.Fprintln(os.Stderr, "ping failed:", resp.Status)
+		return 1
+	}
+	return 0
+}
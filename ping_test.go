@@ -0,0 +1,50 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestPing(t *testing.T) {
+	dir := t.TempDir()
+	healthy, failing := filepath.Join(dir, "healthy.sock"), filepath.Join(dir, "failing.sock")
+	serveUnix(t, healthy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/_ping" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	serveUnix(t, failing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-sock", healthy}, 0},
+		{[]string{"-sock", failing}, 1},
+		{[]string{"-sock", filepath.Join(dir, "missing.sock"), "-timeout", "1s"}, 1},
+		{nil, 2},
+	}
+	for _, test := range tests {
+		if code := ping(test.args); code != test.code {
+			t.Errorf("ping %v exited with %d, expected %d", test.args, code, test.code)
+		}
+	}
+}
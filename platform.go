@@ -0,0 +1,95 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	knownOSes = map[string]bool{
+		"linux": true, "windows": true, "darwin": true, "freebsd": true,
+	}
+	knownArchitectures = map[string]bool{
+		"amd64": true, "386": true, "arm64": true, "arm": true, "ppc64le": true,
+		"s390x": true, "riscv64": true, "mips64le": true, "loong64": true,
+	}
+)
+
+func isVariant(s string) bool {
+	return len(s) >= 2 && s[0] == 'v' && strings.Trim(s[1:], "0123456789") == ""
+}
+
+// Split a platform string such as "linux/arm64/v8" into its components; the
+// variant is empty if not specified
+func splitPlatform(platform string) (os string, arch string, variant string) {
+	parts := strings.SplitN(platform, "/", 3)
+	os = parts[0]
+	if len(parts) > 1 {
+		arch = parts[1]
+	}
+	if len(parts) > 2 {
+		variant = parts[2]
+	}
+	return
+}
+
+// Check whether a platform is the one this program runs on, ignoring the
+// variant
+func isHostPlatform(platform string) bool {
+	os, arch, _ := splitPlatform(platform)
+	return os == runtime.GOOS && arch == runtime.GOARCH
+}
+
+// Docker only understands lowercase platforms, e.g. "linux/arm64" rather than
+// "Linux/ARM64"
+func normalizePlatform(platform string) string {
+	return strings.ToLower(strings.TrimSpace(platform))
+}
+
+// Infer the platform from a socket path named after it, in the form
+// "<anything>-<os>-<arch>[-<variant>].sock", e.g. "docker-linux-arm64.sock"
+func platformFromPath(path string) (string, error) {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, ".sock") {
+		return "", fmt.Errorf("'%s' doesn't end in '.sock'", name)
+	}
+	parts := strings.Split(strings.TrimSuffix(name, ".sock"), "-")
+
+	var matches []int
+	for i := 0; i+1 < len(parts); i++ {
+		if knownOSes[parts[i]] && knownArchitectures[parts[i+1]] {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("'%s' doesn't end in '-<os>-<arch>[-<variant>].sock'", name)
+	} else if len(matches) > 1 {
+		return "", fmt.Errorf("'%s' names more than one platform", name)
+	}
+
+	i := matches[0]
+	platform := parts[i] + "/" + parts[i+1]
+	if i+3 == len(parts) && isVariant(parts[i+2]) {
+		platform += "/" + parts[i+2]
+	} else if i+2 != len(parts) {
+		return "", fmt.Errorf("the platform must be at the end of '%s'", name)
+	}
+	return platform, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPlatformFromPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		platform string
+	}{
+		{"/run/docker-linux-arm64.sock", "linux/arm64"},
+		{"docker-linux-arm-v7.sock", "linux/arm/v7"},
+		{"/tmp/my-proxy-linux-amd64.sock", "linux/amd64"},
+		{"linux-riscv64.sock", "linux/riscv64"},
+		{path: "/run/docker.sock"},
+		{path: "docker-linux-arm64"},
+		{path: "docker-linux-arm64-extra.sock"},
+		{path: "docker-linux-arm64-linux-amd64.sock"},
+		{path: "docker-linux-sparc.sock"},
+		{path: "/run/docker-linux-arm64.sock/docker.sock"},
+	}
+
+	for _, test := range tests {
+		platform, err := platformFromPath(test.path)
+		if test.platform == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, expected an error", test.path, platform)
+			}
+		} else if err != nil || platform != test.platform {
+			t.Errorf("%s: got %s and error %v, expected %s", test.path, platform, err, test.platform)
+		}
+	}
+}
+
+func TestPlatformsAreNormalized(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules")
+	if err := ioutil.WriteFile(rulesPath, []byte("platform docker.io library/alpine Linux/ARM/v7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := printedConfig(t, nil, "-secondary-platform", " Linux/AMD64", "-platform-preference", "Linux/S390X",
+		"/run/docker.sock", "/run/platformify.sock", "Linux/ARM64")
+	expected := map[string]string{
+		"platform":            "linux/arm64",
+		"secondary-platform":  "linux/amd64",
+		"platform-preference": "[linux/s390x]",
+	}
+	for key, value := range expected {
+		if fmt.Sprint(config[key]) != value {
+			t.Errorf("%s is %v, expected %s", key, config[key], value)
+		}
+	}
+
+	rules, err := loadRules(rulesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := &fakeDaemon{}
+	opts := testOptions(daemon)
+	opts.rules = rules
+	opts.allowPlatformOverride = true
+	proxyRequests(t, opts,
+		"POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n",
+		"POST /v1.41/images/create?fromImage=busybox&__platformify=Linux%2FPPC64LE HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n")
+	_, requests, _ := daemon.received()
+	var platforms []string
+	for _, req := range requests {
+		platforms = append(platforms, req.URL.Query().Get("platform"))
+	}
+	if fmt.Sprint(platforms) != "[linux/arm/v7 linux/ppc64le]" {
+		t.Errorf("daemon received platforms %q from a rule and an override", platforms)
+	}
+}
+
+func TestHostPlatformNotice(t *testing.T) {
+	host := runtime.GOOS + "/" + runtime.GOARCH
+	other := "linux/s390x"
+	if host == other {
+		other = "linux/riscv64"
+	}
+	if !isHostPlatform(host+"/v8") || isHostPlatform(other) {
+		t.Errorf("%s/v8 recognized as the host platform: %t, %s: %t", host, isHostPlatform(host+"/v8"), other, isHostPlatform(other))
+	}
+
+	dir := t.TempDir()
+	dockerSock := filepath.Join(dir, "docker.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, platform := range []string{host, other} {
+		_, log := startProxy(t, nil, "-no-banner", dockerSock, filepath.Join(dir, platform[len("linux/"):]+".sock"), platform)
+		// Logged on startup, before listening
+		noticed := false
+		for line := log.waitFor(t, ""); !strings.Contains(line, "listening on"); line = log.waitFor(t, "") {
+			noticed = noticed || strings.Contains(line, "is the platform of this host")
+		}
+		if noticed != (platform == host) {
+			t.Errorf("%s: host platform noticed: %t", platform, noticed)
+		}
+	}
+}
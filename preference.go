@@ -0,0 +1,172 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Platforms that images are available for, as reported by the daemon, kept
+// for a while to spare the registry repeated lookups. Entries are kept per set
+// of registry credentials, which may give access to different images.
+type platformCache struct {
+	mu      sync.Mutex
+	entries map[platformCacheKey]platformCacheEntry
+}
+
+type platformCacheKey struct {
+	image string
+	// Hash of the credentials, which aren't kept around
+	auth [sha256.Size]byte
+}
+
+type platformCacheEntry struct {
+	platforms []string
+	expires   time.Time
+}
+
+var imagePlatformCache = platformCache{entries: make(map[platformCacheKey]platformCacheEntry)}
+
+func (c *platformCache) get(image string, auth string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := platformCacheKey{image, sha256.Sum256([]byte(auth))}
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.platforms, true
+}
+
+// Add an entry, dropping the expired ones so that images pulled only once
+// don't stay around forever
+func (c *platformCache) put(image string, auth string, platforms []string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[platformCacheKey{image, sha256.Sum256([]byte(auth))}] = platformCacheEntry{platforms: platforms, expires: now.Add(ttl)}
+}
+
+// What the registry knows about an image, as reported by the daemon
+type distributionInspect struct {
+	Descriptor struct {
+		// Digest of the manifest, or of the index for multi-platform images
+		Digest string `json:"digest"`
+	}
+	Platforms []struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	}
+}
+
+// Ask the daemon what the registry knows about an image, which makes it fetch
+// the manifest from the registry
+func inspectDistribution(opts *options, image string, auth string) (*distributionInspect, error) {
+	client := &http.Client{Transport: opts.dockerTransport(), Timeout: 30 * time.Second}
+	req, err := http.NewRequest("GET", "http://docker/distribution/"+image+"/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth != "" {
+		req.Header.Set("X-Registry-Auth", auth)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response to GET /distribution/%s/json: %s", image, resp.Status)
+	}
+
+	distribution := &distributionInspect{}
+	if err := json.NewDecoder(resp.Body).Decode(distribution); err != nil {
+		return nil, fmt.Errorf("unable to parse the response to GET /distribution/%s/json: %v", image, err)
+	}
+	return distribution, nil
+}
+
+// Ask the daemon which platforms an image is available for
+func imagePlatforms(opts *options, image string, auth string) ([]string, error) {
+	distribution, err := inspectDistribution(opts, image, auth)
+	if err != nil {
+		return nil, err
+	}
+	platforms := make([]string, 0, len(distribution.Platforms))
+	for _, p := range distribution.Platforms {
+		platform := p.OS + "/" + p.Architecture
+		if p.Variant != "" {
+			platform += "/" + p.Variant
+		}
+		platforms = append(platforms, normalizePlatform(platform))
+	}
+	return platforms, nil
+}
+
+// Check whether an available platform satisfies a preferred one; preferences
+// without a variant accept any
+func platformSatisfies(available string, preferred string) bool {
+	os, arch, variant := splitPlatform(available)
+	preferredOS, preferredArch, preferredVariant := splitPlatform(preferred)
+	return os == preferredOS && arch == preferredArch && (preferredVariant == "" || variant == preferredVariant)
+}
+
+// Pick the preferred platform for the image pulled by an image create request
+// line, or the configured platform if it doesn't pull anything
+func preferredPlatform(opts *options, requestLine []byte, auth string) string {
+	query, err := requestQuery(requestLine)
+	if err != nil || query.Get("fromImage") == "" {
+		return opts.platform
+	}
+	return preferredImagePlatform(opts, pulledImage(query), auth)
+}
+
+// Pick the first platform in the preference list that an image is available
+// for, or the configured platform if there's none or the image can't be looked
+// up
+func preferredImagePlatform(opts *options, image string, auth string) string {
+	platforms, ok := imagePlatformCache.get(image, auth)
+	if !ok {
+		var err error
+		if platforms, err = imagePlatforms(opts, image, auth); err != nil {
+			log.Warningf("unable to look up the platforms of %s, using %s: %v", image, opts.platform, err)
+			return opts.platform
+		}
+		imagePlatformCache.put(image, auth, platforms, opts.platformCacheTTL)
+	}
+
+	for _, preferred := range opts.platformPreference {
+		for _, available := range platforms {
+			if platformSatisfies(available, preferred) {
+				log.Debugf("%s is available for %s, preferred platform %s", image, available, preferred)
+				return preferred
+			}
+		}
+	}
+	return opts.platform
+}
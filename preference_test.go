@@ -0,0 +1,105 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A fake daemon telling that every image is available for linux/amd64 and linux/arm64
+func distributionDaemon() *fakeDaemon {
+	return &fakeDaemon{reply: func(_ int, req *http.Request) (string, bool) {
+		body := `{"Descriptor":{"digest":"sha256:0123"},"Platforms":[{"os":"linux","architecture":"amd64"},{"os":"linux","architecture":"arm64"}]}`
+		return "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body, false
+	}}
+}
+
+// Count the image lookups a fake daemon received
+func lookups(daemon *fakeDaemon) int {
+	_, requests, _ := daemon.received()
+	n := 0
+	for _, req := range requests {
+		if strings.HasPrefix(req.URL.Path, "/distribution/") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPreferredPlatformCachesLookups(t *testing.T) {
+	imagePlatformCache.mu.Lock()
+	imagePlatformCache.entries = make(map[platformCacheKey]platformCacheEntry)
+	imagePlatformCache.mu.Unlock()
+
+	daemon := distributionDaemon()
+	opts := testOptions(daemon)
+	opts.platform = "linux/amd64"
+	opts.platformPreference = []string{"linux/arm64"}
+	opts.platformCacheTTL = time.Hour
+	line := []byte("POST /v1.41/images/create?fromImage=cached-image&tag=1 HTTP/1.1\r")
+
+	for i := 0; i < 3; i++ {
+		if platform := preferredPlatform(opts, line, "credentials"); platform != "linux/arm64" {
+			t.Fatalf("got %s, expected linux/arm64", platform)
+		}
+	}
+	if n := lookups(daemon); n != 1 {
+		t.Errorf("the image was looked up %d times within the TTL, expected once", n)
+	}
+
+	// Other credentials may give access to another image
+	preferredPlatform(opts, line, "other credentials")
+	if n := lookups(daemon); n != 2 {
+		t.Errorf("the image was looked up %d times with two sets of credentials, expected twice", n)
+	}
+
+	opts.platformCacheTTL = time.Millisecond
+	line = []byte("POST /v1.41/images/create?fromImage=expiring-image&tag=1 HTTP/1.1\r")
+	preferredPlatform(opts, line, "")
+	time.Sleep(10 * time.Millisecond)
+	preferredPlatform(opts, line, "")
+	if n := lookups(daemon); n != 4 {
+		t.Errorf("got %d lookups in all, expected the expired one to be looked up again", n)
+	}
+
+	// Lookups share their connections instead of leaving one open each time
+	if dials := atomic.LoadInt32(&daemon.dials); dials != 1 {
+		t.Errorf("the daemon was dialed %d times, expected once", dials)
+	}
+}
+
+func TestPlatformCacheDropsExpiredEntries(t *testing.T) {
+	cache := platformCache{entries: make(map[platformCacheKey]platformCacheEntry)}
+	cache.put("old", "", []string{"linux/amd64"}, time.Millisecond)
+	cache.put("other", "credentials", []string{"linux/amd64"}, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	cache.put("new", "", []string{"linux/arm64"}, time.Hour)
+
+	if len(cache.entries) != 1 {
+		t.Errorf("the cache holds %d entries, expected only the one that didn't expire", len(cache.entries))
+	}
+	if platforms, ok := cache.get("new", ""); !ok || platforms[0] != "linux/arm64" {
+		t.Errorf("got %v, %t", platforms, ok)
+	}
+	if _, ok := cache.get("new", "credentials"); ok {
+		t.Error("the entry was found with other credentials")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Resolve a user name or numeric ID, along with its primary group ID
+func lookupUser(name string) (uid int, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, numErr := strconv.Atoi(name); numErr != nil {
+			return
+		}
+		if u, err = user.LookupId(name); err != nil {
+			// Numeric IDs don't need to exist in the user database
+			uid, _ = strconv.Atoi(name)
+			return uid, -1, nil
+		}
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return
+	}
+	gid, err = strconv.Atoi(u.Gid)
+	return
+}
+
+// Resolve a group name or numeric ID
+func lookupGroup(name string) (gid int, err error) {
+	if gid, err = strconv.Atoi(name); err == nil {
+		return
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// Switch to the given user and/or group; the group defaults to the user's
+// primary group
+func dropPrivileges(userName string, groupName string) error {
+	uid, gid := -1, -1
+	if userName != "" {
+		var err error
+		if uid, gid, err = lookupUser(userName); err != nil {
+			return fmt.Errorf("unable to look up user '%s': %v", userName, err)
+		}
+	}
+	if groupName != "" {
+		var err error
+		if gid, err = lookupGroup(groupName); err != nil {
+			return fmt.Errorf("unable to look up group '%s': %v", groupName, err)
+		}
+	}
+
+	if uid >= 0 && gid < 0 {
+		// Switching the user alone would keep our group and supplementary groups, e.g. root's
+		return &exitError{exitUsage, fmt.Errorf("user '%s' isn't in the user database, so its group must be given with -group", userName)}
+	}
+
+	// The groups must be changed first, we won't be allowed to after setuid. The
+	// supplementary groups are always dropped along with the user.
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("unable to set supplementary groups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("unable to set group ID %d: %w", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("unable to set user ID %d: %w", uid, err)
+		}
+	}
+	return nil
+}
+
+// Remove a file created on startup. Once privileges have been dropped, files
+// in a directory only root can write to, such as /run, can't be removed
+// anymore: they are left behind, and replaced on the next start.
+func removeCreatedFile(path string, description string, dropped bool) {
+	err := os.Remove(path)
+	if err == nil || os.IsNotExist(err) {
+		return
+	}
+	if dropped && os.IsPermission(err) {
+		log.Noticef("leaving %s '%s' behind, it can't be removed after dropping privileges and will be replaced on the next start",
+			description, path)
+		return
+	}
+	log.Warningf("unable to remove %s: %v", description, err)
+}
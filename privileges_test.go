@@ -0,0 +1,97 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestRemoveCreatedFile(t *testing.T) {
+	logs := recordLogs(t, logging.NOTICE)
+	path := filepath.Join(t.TempDir(), "docker-platformify.pid")
+	if err := writePidFile(path); err != nil {
+		t.Fatal(err)
+	}
+	removeCreatedFile(path, "PID file", false)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the PID file wasn't removed: %v", err)
+	}
+	// Already removed
+	removeCreatedFile(path, "PID file", false)
+	if messages := logs.messages(logging.NOTICE, ""); len(messages) > 0 {
+		t.Errorf("unexpected messages: %q", messages)
+	}
+}
+
+func TestRemoveCreatedFileAfterDroppingPrivileges(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("dropping privileges needs root")
+	}
+	// Like /run: anyone can look into it, only root can write to it
+	dir, err := os.MkdirTemp("", "platformify-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "docker-platformify.pid")
+	if err := writePidFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Privileges can't be regained, drop them in another process
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRemoveCreatedFileHelper$")
+	cmd.Env = append(os.Environ(), "PLATFORMIFY_TEST_REMOVE="+path)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("the PID file is gone: %v", err)
+	}
+	if !strings.Contains(string(output), "NOTICE: leaving PID file '"+path+"' behind") {
+		t.Errorf("the PID file being left behind wasn't explained: %s", output)
+	}
+	// The next start replaces it
+	if err := writePidFile(path); err != nil {
+		t.Error(err)
+	}
+}
+
+// Run by TestRemoveCreatedFileAfterDroppingPrivileges
+func TestRemoveCreatedFileHelper(t *testing.T) {
+	path := os.Getenv("PLATFORMIFY_TEST_REMOVE")
+	if path == "" {
+		t.Skip("only run by TestRemoveCreatedFileAfterDroppingPrivileges")
+	}
+	logs := recordLogs(t, logging.NOTICE)
+	if err := dropPrivileges("65534", "65534"); err != nil {
+		t.Fatal(err)
+	}
+	removeCreatedFile(path, "PID file", true)
+	for _, record := range logs.records {
+		fmt.Printf("%s: %s\n", record.level, record.message)
+	}
+}
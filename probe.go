@@ -0,0 +1,107 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Architectures as reported by the daemon (uname -m) mapped to the Go names
+// used in platforms
+var unameArchitectures = map[string]string{
+	"x86_64": "amd64", "i386": "386", "i686": "386", "aarch64": "arm64",
+	"armv7l": "arm", "armv6l": "arm", "ppc64le": "ppc64le", "s390x": "s390x",
+	"riscv64": "riscv64", "mips64": "mips64le", "loongarch64": "loong64",
+}
+
+// Names of the QEMU user mode emulators registered with binfmt_misc, where they
+// differ from the Go names
+var qemuArchitectures = map[string]string{
+	"amd64": "x86_64", "386": "i386", "arm64": "aarch64", "mips64le": "mips64el",
+	"loong64": "loongarch64",
+}
+
+// Architectures that can run the binaries of another one without emulation
+var compatibleArchitectures = map[string]string{
+	"amd64": "386", "arm64": "arm",
+}
+
+// Ask the daemon what it runs on and check whether it can run containers for
+// the platform. Returns the reason why it clearly can't, or an empty string if
+// it may be able to.
+func unsupportedPlatform(opts *options) (string, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return opts.dialDocker(ctx)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Get("http://docker/info")
+	if err != nil {
+		return "", &exitError{exitDaemonUnreachable, err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response to GET /info: %s", resp.Status)
+	}
+	var info struct {
+		OSType       string
+		Architecture string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("unable to parse the response to GET /info: %v", err)
+	}
+
+	os, arch, _ := splitPlatform(opts.platform)
+	if info.OSType != "" && info.OSType != os {
+		return fmt.Sprintf("the daemon runs %s containers, not %s ones", info.OSType, os), nil
+	}
+	daemonArch, ok := unameArchitectures[info.Architecture]
+	if !ok || daemonArch == arch || compatibleArchitectures[daemonArch] == arch {
+		return "", nil
+	}
+	if runtime.GOOS == "linux" && !emulatorRegistered(arch) {
+		return fmt.Sprintf("the daemon runs on %s and no QEMU emulator for %s is registered with binfmt_misc", daemonArch, arch), nil
+	}
+	return "", nil
+}
+
+// Check whether a QEMU user mode emulator for the architecture is registered
+// with binfmt_misc on this host. Returns true when that can't be told, e.g. if
+// binfmt_misc isn't mounted where the proxy can see it.
+func emulatorRegistered(arch string) bool {
+	const binfmtMisc = "/proc/sys/fs/binfmt_misc"
+	if _, err := os.Stat(binfmtMisc + "/status"); err != nil {
+		return true
+	}
+	qemuArch, ok := qemuArchitectures[arch]
+	if !ok {
+		qemuArch = arch
+	}
+	status, err := ioutil.ReadFile(binfmtMisc + "/qemu-" + qemuArch)
+	return err == nil && strings.HasPrefix(string(status), "enabled")
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnsupportedPlatform(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		info        string
+		platform    string
+		unsupported bool
+	}{
+		{`{"OSType":"windows","Architecture":"x86_64"}`, "linux/amd64", true},
+		{`{"OSType":"linux","Architecture":"x86_64"}`, "linux/amd64", false},
+		{`{"OSType":"linux","Architecture":"x86_64"}`, "linux/386", false},
+		{`{"OSType":"linux","Architecture":"aarch64"}`, "linux/arm/v7", false},
+		// Unknown architectures are given the benefit of the doubt
+		{`{"OSType":"linux","Architecture":"pdp11"}`, "linux/arm64", false},
+	}
+	for i, test := range tests {
+		dockerSock := filepath.Join(dir, string(rune('a'+i))+".sock")
+		info := test.info
+		serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/info" {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write([]byte(info))
+		}))
+		opts := &options{platform: test.platform, dockerNetwork: "unix", dockerSock: dockerSock}
+		reason, err := unsupportedPlatform(opts)
+		if err != nil {
+			t.Fatalf("%s on %s: %v", test.platform, info, err)
+		}
+		if (reason != "") != test.unsupported {
+			t.Errorf("%s on %s: got reason '%s', expected unsupported: %t", test.platform, info, reason, test.unsupported)
+		}
+	}
+}
+
+func TestCheckPlatform(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock := filepath.Join(dir, "docker.sock")
+	windowsDaemon(t, dockerSock)
+
+	// Warning, then starting anyway
+	proxy, log := startProxy(t, nil, "-no-banner", "-check-platform", "warn", dockerSock, filepath.Join(dir, "warn.sock"), "linux/arm64")
+	line := log.waitFor(t, "likely can't run them")
+	if !strings.Contains(line, "WARNI") || !strings.Contains(line, "windows containers") {
+		t.Errorf("unexpected warning: %s", line)
+	}
+	log.waitFor(t, "listening on")
+	_ = proxy.Process.Kill()
+
+	// Refusing to start
+	_, stderr, code := runMain(t, nil, "-no-banner", "-check-platform", "refuse", dockerSock, filepath.Join(dir, "refuse.sock"), "linux/arm64")
+	if code != exitUnsupportedPlatform || !strings.Contains(stderr, "the daemon can't run linux/arm64 containers: the daemon runs windows containers") {
+		t.Errorf("exited with code %d: %s", code, stderr)
+	}
+	if strings.Contains(stderr, "listening on") {
+		t.Errorf("listened despite the unsupported platform: %s", stderr)
+	}
+}
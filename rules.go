@@ -0,0 +1,118 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// A rule deciding what happens to pulls of the images it matches
+type rule struct {
+	// One of "allow", "deny" or "platform"
+	action string
+	// Matched against the registry and the rest of the image reference, e.g.
+	// "docker.io" and "library/alpine:3"
+	registry *regexp.Regexp
+	image    *regexp.Regexp
+	// Platform to inject for the "platform" action
+	platform string
+	// Line of the rules file the rule comes from, for logging
+	line int
+	// The rule as written, with normalized spacing
+	text string
+}
+
+// Load an ordered list of rules from a file. Each line holds a rule in the form
+// "<action> <registry> <image> [platform]", where action is "allow" to inject
+// the configured platform, "deny" to reject the pull, or "platform" to inject
+// the given platform instead. Empty lines and lines starting with "#" are
+// ignored.
+func loadRules(rulesPath string) ([]*rule, error) {
+	file, err := os.Open(rulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open rules file: %v", err)
+	}
+	defer file.Close()
+
+	var rules []*rule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		r := &rule{action: fields[0], line: lineNo, text: strings.Join(fields, " ")}
+		switch {
+		case r.action == "platform" && len(fields) == 4:
+			r.platform = normalizePlatform(fields[3])
+		case (r.action == "allow" || r.action == "deny") && len(fields) == 3:
+		default:
+			return nil, fmt.Errorf("%s:%d: expected '<allow|deny> <registry> <image>' or 'platform <registry> <image> <platform>'", rulesPath, lineNo)
+		}
+		r.registry, r.image = wildcardPattern(fields[1]), wildcardPattern(fields[2])
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read rules file: %v", err)
+	}
+	return rules, nil
+}
+
+// Compile a pattern where "*" matches any sequence of characters, "/" included
+func wildcardPattern(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
+
+// Split an image reference into its registry and the rest of it, following the
+// Docker conventions: the first component is only a registry if it looks like
+// a host name, otherwise the image comes from Docker Hub
+func splitRegistry(image string) (registry string, rest string) {
+	if hasRegistry(image) {
+		i := strings.IndexByte(image, '/')
+		return image[:i], image[i+1:]
+	}
+	if !strings.Contains(image, "/") {
+		image = "library/" + image
+	}
+	return "docker.io", image
+}
+
+// Check whether an image reference names its registry, like Docker does: the
+// first path component must look like a host name
+func hasRegistry(image string) bool {
+	i := strings.IndexByte(image, '/')
+	if i < 0 {
+		return false
+	}
+	first := image[:i]
+	return strings.ContainsAny(first, ".:") || first == "localhost"
+}
+
+// Find the first rule matching an image reference, or nil if there's none
+func matchRule(rules []*rule, image string) *rule {
+	registry, rest := splitRegistry(image)
+	for _, r := range rules {
+		if r.registry.MatchString(registry) && r.image.MatchString(rest) {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitRegistry(t *testing.T) {
+	tests := []struct {
+		image    string
+		registry string
+		rest     string
+	}{
+		{"alpine", "docker.io", "library/alpine"},
+		{"alpine:3.18", "docker.io", "library/alpine:3.18"},
+		{"grafana/grafana", "docker.io", "grafana/grafana"},
+		{"docker.io/library/alpine", "docker.io", "library/alpine"},
+		{"ghcr.io/owner/image:1", "ghcr.io", "owner/image:1"},
+		{"localhost/image", "localhost", "image"},
+		{"registry:5000/image", "registry:5000", "image"},
+	}
+
+	for _, test := range tests {
+		if registry, rest := splitRegistry(test.image); registry != test.registry || rest != test.rest {
+			t.Errorf("%s: got %s and %s, expected %s and %s", test.image, registry, rest, test.registry, test.rest)
+		}
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules")
+	err := ioutil.WriteFile(rulesPath, []byte(`# Comments and empty lines are ignored
+
+deny  docker.io      library/ubuntu:*
+platform ghcr.io     owner/*   linux/AMD64
+allow docker.io      library/*
+deny  *              *
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadRules(rulesPath)
+	if err != nil {
+		t.Fatal("unable to load rules:", err)
+	}
+	if len(rules) != 4 || rules[1].platform != "linux/amd64" || rules[0].line != 3 {
+		t.Fatalf("rules loaded incorrectly: %+v", rules)
+	}
+
+	tests := []struct {
+		image string
+		line  int
+	}{
+		{"ubuntu:22.04", 3},
+		{"docker.io/library/ubuntu:22.04", 3},
+		{"ghcr.io/owner/tools/image:1", 4},
+		{"alpine", 5},
+		{"grafana/grafana", 6},
+		{"quay.io/owner/image", 6},
+	}
+	for _, test := range tests {
+		if r := matchRule(rules, test.image); r == nil || r.line != test.line {
+			t.Errorf("%s: matched %+v, expected the rule on line %d", test.image, r, test.line)
+		}
+	}
+	if r := matchRule(rules[:3], "quay.io/owner/image"); r != nil {
+		t.Errorf("matched %+v, expected no rule", r)
+	}
+}
+
+func TestLoadRulesRejectsInvalidLines(t *testing.T) {
+	for _, line := range []string{"allow docker.io", "platform docker.io *", "deny * * linux/amd64", "pick * *"} {
+		rulesPath := filepath.Join(t.TempDir(), "rules")
+		if err := ioutil.WriteFile(rulesPath, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadRules(rulesPath); err == nil {
+			t.Errorf("'%s' was accepted", line)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Query parameters whose values may carry secrets, e.g. build arguments
+var redactedParams = map[string]bool{
+	"buildargs": true,
+}
+
+// A rewritten request, as served by the samples endpoint
+type sample struct {
+	Time     string `json:"time"`
+	Peer     string `json:"peer"`
+	Request  string `json:"request"`
+	Platform string `json:"platform"`
+}
+
+// Keeps the last rewritten requests in a ring buffer, to check what the proxy
+// does without enabling DEBUG logging
+type sampleRing struct {
+	mu      sync.Mutex
+	samples []sample
+	// Where the next sample goes, which is also the oldest one once the ring is full
+	next int
+	full bool
+}
+
+func newSampleRing(size int) *sampleRing {
+	return &sampleRing{samples: make([]sample, size)}
+}
+
+// Record a rewritten request line, redacting the values that may be secret
+func (r *sampleRing) add(peer string, requestLine []byte, platform string) {
+	if r == nil {
+		return
+	}
+	s := sample{
+		Time:     time.Now().Format(time.RFC3339Nano),
+		Peer:     peer,
+		Request:  redactRequestLine(bytes.TrimRight(requestLine, "\r\n")),
+		Platform: platform,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	r.full = r.full || r.next == 0
+}
+
+// Copy of the samples, oldest first
+func (r *sampleRing) list() []sample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]sample{}, r.samples[:r.next]...)
+	}
+	return append(append([]sample{}, r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+func (r *sampleRing) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r.list()); err != nil {
+		log.Error("unable to send samples:", err)
+	}
+}
+
+// Hide the query parameters of a request line that may carry secrets, as well
+// as the passwords of the URLs in the others, e.g. the remote of a build
+func redactRequestLine(requestLine []byte) string {
+	start, end, err := parseRequestLine(requestLine)
+	if err != nil {
+		return string(requestLine)
+	}
+	target, err := url.ParseRequestURI(string(requestLine[start:end]))
+	if err != nil || target.RawQuery == "" {
+		return string(requestLine)
+	}
+	query := target.Query()
+	for name, values := range query {
+		for i, value := range values {
+			if redactedParams[name] {
+				values[i] = "REDACTED"
+			} else {
+				values[i] = redactURL(value)
+			}
+		}
+	}
+	target.RawQuery = query.Encode()
+	return string(requestLine[:start]) + target.RequestURI() + string(requestLine[end:])
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSamples(t *testing.T) {
+	opts := testOptions(&fakeDaemon{})
+	opts.endpoints = []*endpoint{imagesCreate, build}
+	opts.samples = newSampleRing(3)
+	pull := func(image string) string {
+		return "POST /v1.41/images/create?fromImage=" + image + " HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	}
+	proxyRequests(t, opts,
+		pull("first"),
+		// Not rewritten, thus not sampled
+		"GET /v1.41/info HTTP/1.1\r\nHost: docker\r\n\r\n",
+		pull("second"),
+		pull("third"),
+		"POST /v1.41/build?buildargs=%7B%22TOKEN%22%3A%22secret%22%7D&remote=https%3A%2F%2Fuser%3Apassword%40git.example%2Fapp.git HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n",
+	)
+
+	recorder := httptest.NewRecorder()
+	opts.samples.ServeHTTP(recorder, httptest.NewRequest("GET", "/samples", nil))
+	var samples []sample
+	if err := json.Unmarshal(recorder.Body.Bytes(), &samples); err != nil {
+		t.Fatalf("unable to decode samples: %v\n%s", err, recorder.Body.String())
+	}
+	if recorder.Code != http.StatusOK || len(samples) != 3 {
+		t.Fatalf("got status %d and %d samples, expected the last 3", recorder.Code, len(samples))
+	}
+
+	// Oldest first, with the first one pushed out of the ring
+	for i, image := range []string{"second", "third"} {
+		if !strings.HasPrefix(samples[i].Request, "POST /v1.41/images/create?fromImage="+image+"&platform=linux%2Farm64 ") {
+			t.Errorf("sample %d is %q, expected a pull of %s", i, samples[i].Request, image)
+		}
+	}
+	for _, s := range samples {
+		if s.Platform != "linux/arm64" || s.Peer == "" || s.Time == "" {
+			t.Errorf("incomplete sample %+v", s)
+		}
+	}
+	buildSample := samples[2].Request
+	if !strings.HasPrefix(buildSample, "POST /v1.41/build?") || !strings.Contains(buildSample, "buildargs=REDACTED") ||
+		strings.Contains(buildSample, "secret") || strings.Contains(buildSample, "password") {
+		t.Errorf("build sample %q isn't redacted", buildSample)
+	}
+}
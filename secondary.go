@@ -0,0 +1,130 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Find the registry credentials among the headers of a request, if they have
+// already been received
+func registryAuth(request []byte) string {
+	headerEnd := bytes.Index(request, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return ""
+	}
+	for _, line := range bytes.Split(request[:headerEnd], []byte("\r\n"))[1:] {
+		colon := bytes.IndexByte(line, ':')
+		if colon >= 0 && bytes.EqualFold(bytes.TrimSpace(line[:colon]), []byte("X-Registry-Auth")) {
+			return string(bytes.TrimSpace(line[colon+1:]))
+		}
+	}
+	return ""
+}
+
+// Pull the image of an image create request line for the secondary platform
+// as well, over a separate connection to the daemon, so that it's cached for
+// later. It must only be started once the client's own pull is over, so that
+// the two don't race; the image is then pulled by the digest its tag resolves
+// to, so that the tag keeps pointing to the image of the client's platform.
+func pullSecondary(opts *options, requestLine []byte, auth string) {
+	targetStart, targetEnd, err := parseRequestLine(requestLine)
+	if err != nil {
+		log.Warning("unable to pull for the secondary platform:", err)
+		return
+	}
+	target, err := url.Parse(string(requestLine[targetStart:targetEnd]))
+	if err != nil {
+		log.Warning("unable to pull for the secondary platform:", err)
+		return
+	}
+	query := target.Query()
+	image := pulledImage(query)
+	if !strings.Contains(image, "@") {
+		// Without the containerd image store, pulling the tag again would point it to the secondary platform
+		distribution, err := inspectDistribution(opts, image, auth)
+		if err == nil && distribution.Descriptor.Digest == "" {
+			err = errors.New("no digest reported by the registry")
+		}
+		if err != nil {
+			log.Warningf("unable to pull %s for secondary platform %s, its digest is unknown: %v", image, opts.secondaryPlatform, err)
+			return
+		}
+		repository, _ := splitTag(query.Get("fromImage"))
+		query.Set("fromImage", repository)
+		query.Set("tag", distribution.Descriptor.Digest)
+		image = pulledImage(query)
+	}
+	query.Set(opts.platformParam, opts.secondaryPlatform)
+	target.RawQuery = query.Encode()
+
+	client := &http.Client{Transport: opts.dockerTransport()}
+	req, err := http.NewRequest("POST", "http://docker"+target.RequestURI(), nil)
+	if err != nil {
+		log.Warning("unable to pull for the secondary platform:", err)
+		return
+	}
+	if auth != "" {
+		req.Header.Set("X-Registry-Auth", auth)
+	}
+
+	log.Infof("pulling %s for secondary platform %s", image, opts.secondaryPlatform)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Warningf("pull of %s for secondary platform %s failed: %v", image, opts.secondaryPlatform, err)
+		return
+	}
+	defer resp.Body.Close()
+	if err := pullError(resp); err != nil {
+		log.Warningf("pull of %s for secondary platform %s failed: %v", image, opts.secondaryPlatform, err)
+		return
+	}
+	log.Infof("pulled %s for secondary platform %s", image, opts.secondaryPlatform)
+}
+
+// Wait for a pull to finish, returning the error it failed with. The daemon
+// reports errors in the stream of progress messages, after the status code.
+func pullError(resp *http.Response) error {
+	decoder := json.NewDecoder(resp.Body)
+	var message struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		if err := decoder.Decode(&message); err == nil && message.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, message.Message)
+		}
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	for {
+		message.Error = ""
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return fmt.Errorf("%s", message.Error)
+		}
+	}
+}
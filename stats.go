@@ -0,0 +1,81 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Counters describing the proxy activity, updated atomically
+type proxyStats struct {
+	activeConnections int64
+	totalConnections  int64
+	// Connections turned away because of the connection limit
+	rejectedConnections int64
+	injections          int64
+	errors              int64
+	bytesForwarded      int64
+}
+
+var stats proxyStats
+
+func (s *proxyStats) addError() {
+	atomic.AddInt64(&s.errors, 1)
+}
+
+func (s *proxyStats) String() string {
+	return fmt.Sprintf(
+		"active_connections=%d total_connections=%d rejected_connections=%d injections=%d errors=%d bytes_forwarded=%d",
+		atomic.LoadInt64(&s.activeConnections),
+		atomic.LoadInt64(&s.totalConnections),
+		atomic.LoadInt64(&s.rejectedConnections),
+		atomic.LoadInt64(&s.injections),
+		atomic.LoadInt64(&s.errors),
+		atomic.LoadInt64(&s.bytesForwarded),
+	)
+}
+
+// One-line summary of what the proxy did over its lifetime
+func (s *proxyStats) summary(uptime time.Duration) string {
+	return fmt.Sprintf(
+		"served %d connections in %s, %d injections, %d errors",
+		atomic.LoadInt64(&s.totalConnections),
+		uptime.Truncate(time.Millisecond),
+		atomic.LoadInt64(&s.injections),
+		atomic.LoadInt64(&s.errors),
+	)
+}
+
+// Log a snapshot of the stats and of the active connections whenever SIGUSR2
+// is received. The signal is caught before returning, so that it can't
+// terminate the process anymore.
+func logStatsOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			log.Notice("stats:", stats.String())
+			for _, conn := range activeConns.snapshot() {
+				log.Notice("connection:", conn.String())
+			}
+		}
+	}()
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLogStatsOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock, proxySock := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "proxy.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	proxy, log := startProxy(t, nil, "-no-banner", dockerSock, proxySock, "linux/arm64")
+	log.waitFor(t, "listening on")
+
+	// A kept-alive connection, which the proxy is serving once it answered
+	conn, err := net.Dial("unix", proxySock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprint(conn, "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if status := readResponse(t, bufio.NewReader(conn)); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+
+	if err := proxy.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	line := log.waitFor(t, "stats:")
+	for _, stat := range []string{"active_connections=1", "total_connections=1", "injections=1", "errors=0"} {
+		if !strings.Contains(line, stat) {
+			t.Errorf("stats line %q lacks %s", line, stat)
+		}
+	}
+	if line := log.waitFor(t, "connection:"); !strings.Contains(line, "id=1 ") {
+		t.Errorf("connection line %q doesn't describe the open connection", line)
+	}
+}
+
+func TestShutdownSummary(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock, proxySock := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "proxy.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	proxy, log := startProxy(t, nil, "-no-banner", "-shutdown-summary", dockerSock, proxySock, "linux/arm64")
+	log.waitFor(t, "listening on")
+	for i := 0; i < 3; i++ {
+		if status := requestUnix(t, proxySock, "GET", "/_ping"); status != http.StatusOK {
+			t.Fatalf("got status %d", status)
+		}
+	}
+
+	if err := proxy.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	line := log.waitFor(t, "served ")
+	if !strings.Contains(line, "served 3 connections in ") || !strings.Contains(line, ", 0 injections, 0 errors") {
+		t.Errorf("unexpected summary: %s", line)
+	}
+	if err := proxy.Wait(); err != nil {
+		t.Errorf("the proxy exited with %v", err)
+	}
+}
+
+func TestMaxConnectionsSaturation(t *testing.T) {
+	dir := t.TempDir()
+	dockerSock, proxySock := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "proxy.sock")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	proxy, log := startProxy(t, nil, "-no-banner", "-max-connections", "1", dockerSock, proxySock, "linux/arm64")
+	log.waitFor(t, "listening on")
+
+	// Holding the only slot
+	conn, err := net.Dial("unix", proxySock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	log.waitFor(t, "new connection to proxy socket")
+
+	// Rejected right away, without waiting for a request
+	for i := 0; i < 3; i++ {
+		rejected, err := net.Dial("unix", proxySock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = rejected.SetDeadline(time.Now().Add(5 * time.Second))
+		if status := readResponse(t, bufio.NewReader(rejected)); status != http.StatusServiceUnavailable {
+			t.Errorf("got status %d over the limit", status)
+		}
+		_ = rejected.Close()
+	}
+	if err := proxy.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	// The warnings are logged before the rejections, thus before the stats
+	var warnings []string
+	line := log.waitFor(t, "")
+	for ; !strings.Contains(line, "stats:"); line = log.waitFor(t, "") {
+		if strings.Contains(line, "connections reached") {
+			warnings = append(warnings, line)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "limit of 1 connections reached, rejecting new ones (1 rejected so far)") {
+		t.Errorf("expected a single saturation warning in the window, got %q", warnings)
+	}
+	if !strings.Contains(line, "rejected_connections=3") {
+		t.Errorf("stats line %q doesn't count the 3 rejected connections", line)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// Client connection over the process' standard input and output, for use as a
+// "docker system dial-stdio"-style helper
+type stdioConn struct {
+	in  *os.File
+	out *os.File
+	// Whether the descriptors were non-blocking to begin with. They are shared
+	// with the parent, e.g. a shell, so their mode is restored on close.
+	inNonblock  bool
+	outNonblock bool
+}
+
+func newStdioConn() *stdioConn {
+	c := &stdioConn{
+		inNonblock:  isNonblocking(syscall.Stdin),
+		outNonblock: isNonblocking(syscall.Stdout),
+	}
+	// Non-blocking descriptors can be added to the poller, which makes read
+	// deadlines work on pipes and sockets
+	_ = syscall.SetNonblock(syscall.Stdin, true)
+	_ = syscall.SetNonblock(syscall.Stdout, true)
+	c.in = os.NewFile(uintptr(syscall.Stdin), "stdin")
+	c.out = os.NewFile(uintptr(syscall.Stdout), "stdout")
+	return c
+}
+
+func isNonblocking(fd int) bool {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFL, 0)
+	return errno == 0 && flags&syscall.O_NONBLOCK != 0
+}
+
+func (c *stdioConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c *stdioConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+func (c *stdioConn) LocalAddr() net.Addr         { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr        { return stdioAddr{} }
+
+func (c *stdioConn) Close() error {
+	_ = syscall.SetNonblock(syscall.Stdin, c.inNonblock)
+	_ = syscall.SetNonblock(syscall.Stdout, c.outNonblock)
+	inErr := c.in.Close()
+	if err := c.out.Close(); err != nil {
+		return err
+	}
+	return inErr
+}
+
+// Deadlines are not supported on every kind of file (e.g. regular files), in
+// which case reads simply block
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	_ = c.in.SetDeadline(t)
+	_ = c.out.SetDeadline(t)
+	return nil
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error {
+	_ = c.in.SetReadDeadline(t)
+	return nil
+}
+
+func (c *stdioConn) SetWriteDeadline(t time.Time) error {
+	_ = c.out.SetWriteDeadline(t)
+	return nil
+}
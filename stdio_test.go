@@ -0,0 +1,63 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestStdioMode(t *testing.T) {
+	dockerSock := filepath.Join(t.TempDir(), "docker.sock")
+	platforms := make(chan string, 1)
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		platforms <- r.URL.Query().Get("platform")
+	}))
+
+	cmd := mainCommand(t, nil, "-listen-mode", "stdio", dockerSock, "linux/arm64")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal("unable to start the proxy:", err)
+	}
+	defer func() { _ = cmd.Process.Kill() }()
+
+	// Standard output only carries the API stream, the banner goes to standard error
+	if _, err := fmt.Fprint(stdin, "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"); err != nil {
+		t.Fatal("unable to send request:", err)
+	}
+	if status := readResponse(t, bufio.NewReader(stdout)); status != http.StatusOK {
+		t.Errorf("got status %d", status)
+	}
+	if platform := <-platforms; platform != "linux/arm64" {
+		t.Errorf("daemon received platform %q", platform)
+	}
+
+	// The proxy is done once the client hangs up
+	_ = stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("the proxy exited with %v", err)
+	}
+}
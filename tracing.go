@@ -0,0 +1,231 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal OpenTelemetry tracing, exported to a collector with OTLP over
+// HTTP/JSON. The OpenTelemetry SDK needs a much newer Go than this module
+// targets and would bring in dozens of dependencies for a couple of spans.
+// All the methods are no-ops on a nil tracer or span, so tracing costs nothing
+// when disabled.
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	// Spans are exported in batches of at most this size
+	maxSpanBatch = 128
+)
+
+type span struct {
+	tracer     *tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+}
+
+type tracer struct {
+	// OTLP/HTTP traces endpoint, e.g. "http://localhost:4318/v1/traces"
+	endpoint string
+	client   *http.Client
+	spans    chan *span
+	stop     chan struct{}
+	done     sync.WaitGroup
+}
+
+func newTracer(endpoint string) *tracer {
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	t := &tracer{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, 4*maxSpanBatch),
+		stop:     make(chan struct{}),
+	}
+	t.done.Add(1)
+	go t.export()
+	return t
+}
+
+// Start a span; its trace is inherited from parent, unless parent is nil
+func (t *tracer) startSpan(name string, parent *span, start time.Time) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{tracer: t, name: name, kind: spanKindInternal, start: start, attributes: map[string]string{}}
+	_, _ = rand.Read(s.spanID[:])
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.kind = spanKindServer
+		_, _ = rand.Read(s.traceID[:])
+	}
+	return s
+}
+
+func (s *span) setAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// End the span and queue it for export; spans are dropped rather than blocking
+// if the collector can't keep up
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+		log.Debug("dropping trace span, export queue is full")
+	}
+}
+
+// Export the queued spans and stop; spans finished afterwards are discarded
+func (t *tracer) shutdown() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	t.done.Wait()
+}
+
+func (t *tracer) export() {
+	defer t.done.Done()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= maxSpanBatch {
+				t.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.send(batch)
+			batch = nil
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					t.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	result := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		result = append(result, otlpAttribute{key, otlpValue{value}})
+	}
+	return result
+}
+
+func (t *tracer) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.parentID != ([8]byte{}) {
+			spans[i].ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": "docker-platformify"}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "docker-platformify"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Error("unable to encode trace spans:", err)
+		return
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warning("unable to export trace spans:", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Warning("unable to export trace spans, collector replied", resp.Status)
+	}
+}
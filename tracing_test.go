@@ -0,0 +1,112 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// A collector keeping the spans exported to it in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func (r *spanRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if req.URL.Path != "/v1/traces" || json.NewDecoder(req.Body).Decode(&payload) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, resource := range payload.ResourceSpans {
+		for _, scope := range resource.ScopeSpans {
+			r.spans = append(r.spans, scope.Spans...)
+		}
+	}
+}
+
+func (r *spanRecorder) named(name string) []otlpSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var spans []otlpSpan
+	for _, s := range r.spans {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func spanAttributes(s otlpSpan) map[string]string {
+	attributes := map[string]string{}
+	for _, attribute := range s.Attributes {
+		attributes[attribute.Key] = attribute.Value.StringValue
+	}
+	return attributes
+}
+
+func TestTracingInjection(t *testing.T) {
+	recorder := &spanRecorder{}
+	collector := httptest.NewServer(recorder)
+	defer collector.Close()
+
+	opts := testOptions(&fakeDaemon{})
+	opts.tracer = newTracer(collector.URL)
+	proxyRequests(t, opts,
+		"GET /v1.41/version HTTP/1.1\r\nHost: docker\r\n\r\n",
+		"POST /v1.41/images/create?fromImage=alpine&tag=3.19 HTTP/1.1\r\nHost: docker\r\n\r\n")
+	// Exports the spans still queued
+	opts.tracer.shutdown()
+
+	connections, injections := recorder.named("connection"), recorder.named("inject")
+	if len(connections) != 1 || len(injections) != 1 {
+		t.Fatalf("got %d connection and %d inject spans, expected one each", len(connections), len(injections))
+	}
+	connection, injection := connections[0], injections[0]
+	if connection.Kind != spanKindServer || connection.ParentSpanID != "" ||
+		spanAttributes(connection)["docker.platform"] != "linux/arm64" {
+		t.Errorf("unexpected connection span %+v", connection)
+	}
+	if injection.TraceID != connection.TraceID || injection.ParentSpanID != connection.SpanID {
+		t.Errorf("inject span %+v isn't a child of the connection span", injection)
+	}
+	expected := map[string]string{
+		"docker.endpoint": "docker image create/pull",
+		"docker.platform": "linux/arm64",
+		"docker.image":    "alpine:3.19",
+	}
+	if attributes := spanAttributes(injection); len(attributes) != len(expected) {
+		t.Errorf("inject span has attributes %v, expected %v", attributes, expected)
+	} else {
+		for key, value := range expected {
+			if attributes[key] != value {
+				t.Errorf("inject span has %s=%s, expected %s", key, attributes[key], value)
+			}
+		}
+	}
+}
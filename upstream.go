@@ -0,0 +1,55 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Periodically check whether the Docker daemon accepts connections, logging
+// whenever that changes, e.g. while the daemon restarts and recreates its
+// socket. Client connections always dial a fresh connection, so they work
+// again as soon as the daemon is back.
+func watchUpstream(opts *options, stop <-chan struct{}) {
+	ticker := time.NewTicker(opts.upstreamCheckInterval)
+	defer ticker.Stop()
+
+	available := true
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), opts.upstreamCheckInterval)
+		conn, err := opts.dialDocker(ctx)
+		cancel()
+		if err == nil {
+			_ = conn.Close()
+		}
+
+		if (err == nil) != available {
+			available = err == nil
+			if available {
+				log.Notice("Docker daemon is available again")
+			} else {
+				log.Warning("Docker daemon is unavailable:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2020  Davide Depau <davide@depau.eu>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// Wait for a message containing substring to be recorded
+func waitForLog(t *testing.T, logs *logRecorder, level logging.Level, substring string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !logs.contains(level, substring); {
+		if time.Now().After(deadline) {
+			t.Fatalf("'%s' wasn't logged; logged %q", substring, logs.messages(logging.DEBUG, ""))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchUpstream(t *testing.T) {
+	logs := recordLogs(t, logging.NOTICE)
+	dockerSock := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", dockerSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = daemon.Serve(ln) }()
+
+	opts := &options{
+		dockerNetwork:         "unix",
+		dockerSock:            dockerSock,
+		platform:              "linux/arm64",
+		platformParam:         "platform",
+		platformMode:          "replace",
+		endpoints:             []*endpoint{imagesCreate},
+		upstreamCheckInterval: 20 * time.Millisecond,
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchUpstream(opts, stop)
+
+	// The daemon goes away along with its socket, then comes back
+	_ = daemon.Close()
+	waitForLog(t, logs, logging.WARNING, "Docker daemon is unavailable")
+	serveUnix(t, dockerSock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	waitForLog(t, logs, logging.NOTICE, "Docker daemon is available again")
+
+	pull := "POST /v1.41/images/create?fromImage=alpine HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n"
+	if statuses := proxyRequests(t, opts, pull); statuses[0] != http.StatusOK {
+		t.Errorf("got status %d pulling after the daemon came back", statuses[0])
+	}
+	if n := len(logs.messages(logging.WARNING, "Docker daemon is unavailable")); n != 1 {
+		t.Errorf("the daemon was reported unavailable %d times", n)
+	}
+}